@@ -1,15 +1,22 @@
 package main
 
 import (
-	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 
+	"github.com/fd/dkr-util/pkg/archive"
 	"github.com/fd/dkr-util/pkg/cat"
 	"github.com/fd/dkr-util/pkg/package"
+	"github.com/fd/dkr-util/pkg/pull"
 	"github.com/fd/dkr-util/pkg/push"
+	"github.com/fd/dkr-util/pkg/registry"
+	"github.com/fd/dkr-util/pkg/remote"
+	"github.com/fd/dkr-util/pkg/tag"
 	"gopkg.in/alecthomas/kingpin.v2"
 	"limbo.services/version"
 )
@@ -24,49 +31,259 @@ func main() {
 
 func run() error {
 	var (
-		inputTar  string
-		outputTar string
+		inputTar     string
+		inputTars    []string
+		rootfsDirs   []string
+		platforms    []string
+		baseTar      string
+		outputTar    string
+		imageRef     string
+		dstRef       string
+		resultFile   string
+		tags         []string
+		tagOpts      dkrtag.Options
+		lsRemoteOpts dkrremote.ListOptions
+		deleteOpts   dkrremote.DeleteOptions
+		pruneOpts    dkrremote.PruneOptions
+		imageName    string
+		platform     string
+		fsPath       string
+		packageOpts  dkrpackage.Options
+		pushOpts     dkrpush.Options
+		pullOpts     dkrpull.Options
+		regConf      dkrregistry.Config
+		mirrors      []string
 	)
 
 	app := kingpin.New("dkr", "Docker utilities").Version(version.Get().String()).Author(version.Get().ReleasedBy)
 
+	app.Flag("insecure-registry", "Registry that may be reached over plain HTTP or without verifying its certificate (repeat for more)").PlaceHolder("HOST").StringsVar(&regConf.Insecure)
+	app.Flag("certs-dir", "Directory with a CA and client certificate directory per registry host").Default(dkrregistry.DefaultCertsDir).Envar("DKR_CERTS_DIR").PlaceHolder("DIR").StringVar(&regConf.CertsDir)
+
+	app.Flag("registry-mirror", "Endpoint to try before a registry, e.g. docker.io=mirror.example.com (repeat to try several in order)").PlaceHolder("REGISTRY=ENDPOINT").StringsVar(&mirrors)
+
 	packageCmd := app.Command("package", "Make a new image without running docker")
-	packageCmd.Flag("input", "Tar archive to use").Short('i').Default("-").PlaceHolder("FILE").StringVar(&inputTar)
+	packageCmd.Flag("input", "Tar archive to use (repeat to add layers, defaults to stdin)").Short('i').PlaceHolder("FILE").StringsVar(&inputTars)
+	packageCmd.Flag("rootfs", "Directory to package as a layer, added on top of the inputs (repeat to add layers)").PlaceHolder("DIR").StringsVar(&rootfsDirs)
 	packageCmd.Flag("output", "Path to output Tar archive").Short('o').Default("-").PlaceHolder("FILE").StringVar(&outputTar)
+	packageCmd.Flag("base", "Image archive to build on top of").PlaceHolder("FILE").StringVar(&baseTar)
+	packageCmd.Flag("platform", "Tar archive or directory of one platform of a multi-platform image, added on top of the inputs (repeat for each platform)").PlaceHolder("OS/ARCH[/VARIANT]=FILE").StringsVar(&platforms)
+	packageCmd.Flag("verbose", "Report the files that are excluded from the layers").Short('v').BoolVar(&packageOpts.Verbose)
+	packageCmd.Flag("format", "Archive format (docker or oci, multi-platform images are always oci)").EnumVar(&packageOpts.Format, dkrarchive.FormatDocker, dkrarchive.FormatOCI)
 
-	pushCmd := app.Command("push", "Push an image archive to a registry")
+	pushCmd := app.Command("push", "Push an image archive or OCI image layout to a registry")
 	pushCmd.Flag("input", "Tar archive to use").Short('i').Default("-").PlaceHolder("FILE").StringVar(&inputTar)
+	pushCmd.Flag("schema1", "Push signed schema 1 manifests (for old registries)").BoolVar(&pushOpts.Schema1)
+	pushCmd.Flag("jobs", "Number of blobs to upload concurrently").Short('j').Default("4").IntVar(&pushOpts.Jobs)
+	pushCmd.Flag("result-file", "Write the pushed tags and digests to a JSON file").PlaceHolder("FILE").StringVar(&resultFile)
+
+	pullCmd := app.Command("pull", "Pull an image from a registry into an image archive")
+	pullCmd.Arg("image", "Image reference (by tag or digest)").Required().StringVar(&imageRef)
+	pullCmd.Flag("output", "Path to output Tar archive").Short('o').Default("-").PlaceHolder("FILE").StringVar(&outputTar)
+	pullCmd.Flag("format", "Archive format (docker or oci, multi-platform images are always oci)").Default(dkrarchive.FormatDocker).EnumVar(&pullOpts.Format, dkrarchive.FormatDocker, dkrarchive.FormatOCI)
+	pullCmd.Flag("platform", "Pull only the image for one platform of a multi-platform image").PlaceHolder("OS/ARCH[/VARIANT]").StringVar(&platform)
+
+	copyCmd := app.Command("copy", "Copy an image from one registry reference to another")
+	copyCmd.Arg("src", "Source image reference (by tag or digest)").Required().StringVar(&imageRef)
+	copyCmd.Arg("dst", "Destination image reference").Required().StringVar(&dstRef)
+	copyCmd.Flag("jobs", "Number of blobs to copy concurrently").Short('j').Default("4").IntVar(&pushOpts.Jobs)
+	copyCmd.Flag("result-file", "Write the copied tag and digest to a JSON file").PlaceHolder("FILE").StringVar(&resultFile)
+
+	tagCmd := app.Command("tag", "Add tags to an image in a registry without uploading it again")
+	tagCmd.Arg("image", "Image reference (by tag or digest)").Required().StringVar(&imageRef)
+	tagCmd.Arg("tags", "Tags to add (:TAG adds a tag in the same repository)").Required().StringsVar(&tags)
+
+	retagCmd := app.Command("retag", "Add tags to an image in an image archive")
+	retagCmd.Arg("tags", "Tags to add (:TAG adds a tag in the repositories of the image)").Required().StringsVar(&tags)
+	retagCmd.Flag("input", "Tar archive to use").Short('i').Default("-").PlaceHolder("FILE").StringVar(&inputTar)
+	retagCmd.Flag("output", "Path to output Tar archive").Short('o').Default("-").PlaceHolder("FILE").StringVar(&outputTar)
+	retagCmd.Flag("image", "Image to tag when the archive contains several").PlaceHolder("TAG").StringVar(&tagOpts.Image)
+	retagCmd.Flag("replace", "Remove the current tags of the image").BoolVar(&tagOpts.Replace)
+
+	lsRemoteCmd := app.Command("ls-remote", "List the tags of a repository in a registry")
+	lsRemoteCmd.Arg("repository", "Repository name").Required().StringVar(&imageRef)
+	lsRemoteCmd.Flag("long", "Show the digest, media type, size and creation time of every tag").Short('l').BoolVar(&lsRemoteOpts.Long)
+	lsRemoteCmd.Flag("json", "Print the tags with their details as JSON").BoolVar(&lsRemoteOpts.JSON)
+
+	deleteCmd := app.Command("delete", "Delete the manifest of an image from a registry (with all its tags)")
+	deleteCmd.Arg("image", "Image reference (by tag or digest)").Required().StringVar(&imageRef)
+	deleteCmd.Flag("dry-run", "Only print what would be deleted").BoolVar(&deleteOpts.DryRun)
+
+	pruneCmd := app.Command("prune", "Delete the tags of a repository that no retention rule keeps")
+	pruneCmd.Arg("repository", "Repository name").Required().StringVar(&imageRef)
+	pruneCmd.Flag("keep", "Keep the newest N tags").PlaceHolder("N").IntVar(&pruneOpts.Keep)
+	pruneCmd.Flag("keep-tag", "Also keep the tags matching a glob, on top of --keep or --older-than (repeat for more)").PlaceHolder("GLOB").StringsVar(&pruneOpts.KeepTags)
+	pruneCmd.Flag("older-than", "Keep the tags created less than this long ago (e.g. 720h)").PlaceHolder("DURATION").DurationVar(&pruneOpts.OlderThan)
+	pruneCmd.Flag("dry-run", "Only print what would be deleted").BoolVar(&pruneOpts.DryRun)
 
 	catTagsCmd := app.Command("cat-tags", "Print the tags conatined in an image archive")
 	catTagsCmd.Flag("input", "Tar archive to use").Short('i').Default("-").PlaceHolder("FILE").StringVar(&inputTar)
 
-	switch kingpin.MustParse(app.Parse(os.Args[1:])) {
+	inspectCmd := app.Command("inspect", "Print the metadata of the images in an image archive as JSON")
+	inspectCmd.Flag("input", "Tar archive to use").Short('i').Default("-").PlaceHolder("FILE").StringVar(&inputTar)
+
+	lsCmd := app.Command("ls", "List the files in an image archive")
+	lsCmd.Arg("path", "Directory or file to list").Default("/").StringVar(&fsPath)
+	lsCmd.Flag("input", "Tar archive to use").Short('i').Default("-").PlaceHolder("FILE").StringVar(&inputTar)
+	lsCmd.Flag("image", "Image to use when the archive contains several").PlaceHolder("TAG").StringVar(&imageName)
+	lsCmd.Flag("platform", "Platform to use when the image has several").PlaceHolder("OS/ARCH").StringVar(&platform)
+
+	extractCmd := app.Command("extract", "Write a file (or a tar of a directory) from an image archive to stdout")
+	extractCmd.Arg("path", "File or directory to extract").Required().StringVar(&fsPath)
+	extractCmd.Flag("input", "Tar archive to use").Short('i').Default("-").PlaceHolder("FILE").StringVar(&inputTar)
+	extractCmd.Flag("image", "Image to use when the archive contains several").PlaceHolder("TAG").StringVar(&imageName)
+	extractCmd.Flag("platform", "Platform to use when the image has several").PlaceHolder("OS/ARCH").StringVar(&platform)
+
+	command := kingpin.MustParse(app.Parse(os.Args[1:]))
+
+	for _, mirror := range mirrors {
+		err := regConf.AddMirror(mirror)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch command {
 
 	case packageCmd.FullCommand():
+		if len(inputTars) == 0 && len(rootfsDirs) == 0 && len(platforms) == 0 {
+			inputTars = []string{stdio}
+		}
+
+		var rs []io.Reader
+		for _, name := range inputTars {
+			r, err := openStream(name)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			rs = append(rs, r)
+		}
+		for _, dir := range rootfsDirs {
+			r := dkrpackage.RootFS(dir)
+			defer r.Close()
+			rs = append(rs, r)
+		}
+
+		for _, arg := range platforms {
+			idx := strings.Index(arg, "=")
+			if idx < 0 {
+				return fmt.Errorf("invalid platform input %q (expected OS/ARCH=FILE)", arg)
+			}
+
+			platform, err := dkrarchive.ParsePlatform(arg[:idx])
+			if err != nil {
+				return err
+			}
+
+			r, err := openInput(arg[idx+1:])
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			packageOpts.Platforms = append(packageOpts.Platforms, dkrpackage.PlatformInput{Platform: platform, Src: r})
+		}
+
+		if baseTar != "" {
+			r, err := openStream(baseTar)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			packageOpts.Base = r
+		}
+
+		err := putStream(outputTar, func(w io.Writer) error {
+			return dkrpackage.Package(w, rs, packageOpts)
+		})
+		if err != nil {
+			return err
+		}
+
+	case pushCmd.FullCommand():
+		pushOpts.Registry = regConf
 		r, err := openStream(inputTar)
 		if err != nil {
 			return err
 		}
+		defer r.Close()
 
-		var buf bytes.Buffer
+		result, err := dkrpush.Push(r, pushOpts)
+		if err != nil {
+			return err
+		}
 
-		err = dkrpackage.Package(&buf, r)
+		err = writeResult(resultFile, result)
 		if err != nil {
 			return err
 		}
 
-		err = putStream(outputTar, &buf)
+	case pullCmd.FullCommand():
+		pullOpts.Registry = regConf
+		if platform != "" {
+			p, err := dkrarchive.ParsePlatform(platform)
+			if err != nil {
+				return err
+			}
+			pullOpts.Platform = p
+		}
+		err := putStream(outputTar, func(w io.Writer) error {
+			return dkrpull.Pull(w, imageRef, pullOpts)
+		})
 		if err != nil {
 			return err
 		}
 
-	case pushCmd.FullCommand():
+	case copyCmd.FullCommand():
+		pushOpts.Registry = regConf
+		result, err := dkrpush.Copy(imageRef, dstRef, pushOpts)
+		if err != nil {
+			return err
+		}
+
+		err = writeResult(resultFile, result)
+		if err != nil {
+			return err
+		}
+
+	case tagCmd.FullCommand():
+		pushOpts.Registry = regConf
+		err := dkrtag.Remote(imageRef, tags, pushOpts)
+		if err != nil {
+			return err
+		}
+
+	case retagCmd.FullCommand():
 		r, err := openStream(inputTar)
 		if err != nil {
 			return err
 		}
+		defer r.Close()
 
-		err = dkrpush.Push(r)
+		err = putStream(outputTar, func(w io.Writer) error {
+			return dkrtag.Archive(w, r, tags, tagOpts)
+		})
+		if err != nil {
+			return err
+		}
+
+	case lsRemoteCmd.FullCommand():
+		lsRemoteOpts.Registry = regConf
+		err := dkrremote.List(os.Stdout, imageRef, lsRemoteOpts)
+		if err != nil {
+			return err
+		}
+
+	case deleteCmd.FullCommand():
+		deleteOpts.Registry = regConf
+		err := dkrremote.Delete(imageRef, deleteOpts)
+		if err != nil {
+			return err
+		}
+
+	case pruneCmd.FullCommand():
+		pruneOpts.Registry = regConf
+		err := dkrremote.Prune(imageRef, pruneOpts)
 		if err != nil {
 			return err
 		}
@@ -76,8 +293,45 @@ func run() error {
 		if err != nil {
 			return err
 		}
+		defer r.Close()
+
+		err = dkrcat.Tags(os.Stdout, r)
+		if err != nil {
+			return err
+		}
+
+	case inspectCmd.FullCommand():
+		r, err := openStream(inputTar)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		err = dkrcat.Inspect(os.Stdout, r)
+		if err != nil {
+			return err
+		}
+
+	case lsCmd.FullCommand():
+		r, err := openStream(inputTar)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		err = dkrcat.List(os.Stdout, r, imageName, platform, fsPath)
+		if err != nil {
+			return err
+		}
+
+	case extractCmd.FullCommand():
+		r, err := openStream(inputTar)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
 
-		err = dkrcat.Tags(r)
+		err = dkrcat.Extract(os.Stdout, r, imageName, platform, fsPath)
 		if err != nil {
 			return err
 		}
@@ -89,17 +343,70 @@ func run() error {
 
 const stdio = "-"
 
-func openStream(name string) (io.Reader, error) {
+// openStream opens the named input. Closing stdin is a no-op.
+func openStream(name string) (io.ReadCloser, error) {
 	if name == stdio {
-		return os.Stdin, nil
+		return ioutil.NopCloser(os.Stdin), nil
 	}
 	return os.Open(name)
 }
 
-func putStream(name string, buf *bytes.Buffer) error {
+// openInput opens a tar archive, or the rootfs tar stream of a directory.
+func openInput(name string) (io.ReadCloser, error) {
+	if name != stdio {
+		if info, err := os.Stat(name); err == nil && info.IsDir() {
+			return dkrpackage.RootFS(name), nil
+		}
+	}
+	return openStream(name)
+}
+
+// putStream calls write with the named output. Files are written to a
+// temporary file next to them and only replaced when write succeeds.
+func putStream(name string, write func(w io.Writer) error) error {
 	if name == stdio {
-		_, err := io.Copy(os.Stdout, buf)
+		return write(os.Stdout)
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	err = write(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	err = f.Chmod(0644)
+	if err != nil {
+		f.Close()
 		return err
 	}
-	return ioutil.WriteFile(name, buf.Bytes(), 0644)
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), name)
+}
+
+// writeResult writes result as JSON to the named file, if any.
+func writeResult(name string, result interface{}) error {
+	if name == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return putStream(name, func(w io.Writer) error {
+		_, err := fmt.Fprintf(w, "%s\n", data)
+		return err
+	})
 }
@@ -0,0 +1,439 @@
+package dkrarchive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/docker/distribution/digest"
+)
+
+const (
+	AnnotationRefName   = "org.opencontainers.image.ref.name"
+	AnnotationImageName = "io.containerd.image.name"
+)
+
+// Archive is the raw content of an image archive. It is either in the
+// `docker save` layout (Manifest, Images and Layers) or in the OCI image
+// layout (Index and Blobs).
+type Archive struct {
+	Manifest []ManifestEntry
+	Images   map[string][]byte
+	Layers   map[string]*Content
+
+	// OCI image layout
+	Index *Index
+	Blobs map[digest.Digest]*Content
+
+	layers map[digest.Digest]*Layer
+}
+
+type ManifestEntry struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+type Index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+type Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+}
+
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      digest.Digest     `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *Platform         `json:"platform,omitempty"`
+}
+
+// Platform is the platform an image in an index runs on.
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// Image is a single image from an archive with its layers uncompressed.
+type Image struct {
+	RepoTags []string
+	Config   []byte
+	Layers   []*Layer
+
+	// Manifest is the original manifest of an image read from an OCI image
+	// layout or a registry.
+	Manifest          []byte
+	ManifestMediaType string
+
+	// ManifestEntry is the manifest.json entry of an image read from a
+	// `docker save` archive.
+	ManifestEntry *ManifestEntry
+	// IndexEntries are the index.json entries of an image read from an OCI
+	// image layout.
+	IndexEntries []Descriptor
+
+	// Platform is set for the images of an ImageIndex.
+	Platform *Platform
+}
+
+// ImageIndex is a multi-platform image: an OCI image index (or docker
+// manifest list) with one image per platform.
+type ImageIndex struct {
+	RepoTags []string
+	Images   []*Image
+
+	// Manifest is the original index of an image index read from an OCI
+	// image layout.
+	Manifest          []byte
+	ManifestMediaType string
+
+	IndexEntries []Descriptor
+}
+
+// Layer is an uncompressed layer tar. Blob optionally holds the gzipped
+// layer, either as it was found in a registry or OCI image layout or once
+// it has been compressed for writing.
+type Layer struct {
+	DiffID string
+	Tar    *Content
+	Blob   *Content
+}
+
+// NewLayer returns the layer for an uncompressed layer tar.
+func NewLayer(tar *Content) *Layer {
+	return &Layer{DiffID: tar.Digest.Hex(), Tar: tar}
+}
+
+// Read reads an image archive. Layers and blobs are stored in the spool,
+// only manifests and image configs are kept in memory.
+func Read(src io.Reader, spool *Spool) (*Archive, error) {
+	a := &Archive{
+		Images: map[string][]byte{},
+		Layers: map[string]*Content{},
+		Blobs:  map[digest.Digest]*Content{},
+	}
+
+	r := tar.NewReader(src)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if len(hdr.Name) == 64+len("/layer.tar") && strings.HasSuffix(hdr.Name, "/layer.tar") {
+			layerID := strings.TrimSuffix(hdr.Name, "/layer.tar")
+
+			c, err := spool.Copy(r)
+			if err != nil {
+				return nil, err
+			}
+			a.Layers[layerID] = c
+		}
+
+		if len(hdr.Name) == 64+5 && strings.HasSuffix(hdr.Name, ".json") {
+			imageID := strings.TrimSuffix(hdr.Name, ".json")
+
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				return nil, err
+			}
+			a.Images[imageID] = data
+		}
+
+		if hdr.Name == "manifest.json" {
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				return nil, err
+			}
+			err = json.Unmarshal(data, &a.Manifest)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if hdr.Name == "index.json" {
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				return nil, err
+			}
+			err = json.Unmarshal(data, &a.Index)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if len(hdr.Name) == len("blobs/sha256/")+64 && strings.HasPrefix(hdr.Name, "blobs/sha256/") && hdr.Typeflag == tar.TypeReg {
+			blobDigest := digest.NewDigestFromHex("sha256", strings.TrimPrefix(hdr.Name, "blobs/sha256/"))
+
+			c, err := spool.Copy(r)
+			if err != nil {
+				return nil, err
+			}
+			if c.Digest != blobDigest {
+				return nil, fmt.Errorf("blob %s has digest %s", blobDigest, c.Digest)
+			}
+			a.Blobs[blobDigest] = c
+		}
+
+		io.Copy(ioutil.Discard, r)
+	}
+
+	return a, nil
+}
+
+// ImageName returns the full image reference of an OCI index entry. It
+// returns an empty string when the entry only names a tag.
+func ImageName(desc Descriptor) string {
+	name := desc.Annotations[AnnotationImageName]
+	if name == "" {
+		name = desc.Annotations[AnnotationRefName]
+	}
+	if !strings.Contains(name, "/") {
+		return ""
+	}
+	return name
+}
+
+// ReadImages returns the images contained in the archive, regardless of
+// its layout. Compressed layers are decompressed into the spool. Images
+// that share a layer share its *Layer, so it is only compressed once.
+func (a *Archive) ReadImages(spool *Spool) ([]*Image, error) {
+	if a.Index != nil {
+		return a.readOCIImages(spool)
+	}
+
+	var (
+		images []*Image
+		layers = map[string]*Layer{}
+	)
+	for i := range a.Manifest {
+		e := &a.Manifest[i]
+		config, ok := a.Images[strings.TrimSuffix(e.Config, ".json")]
+		if !ok {
+			return nil, fmt.Errorf("missing image config %s", e.Config)
+		}
+
+		img := &Image{RepoTags: e.RepoTags, Config: config, ManifestEntry: e}
+		for _, layerPath := range e.Layers {
+			// docker save names the layer directories after v1 IDs, so the
+			// diff ID must be computed from the layer itself.
+			layerID := strings.TrimSuffix(layerPath, "/layer.tar")
+			l := layers[layerID]
+			if l == nil {
+				c, ok := a.Layers[layerID]
+				if !ok {
+					return nil, fmt.Errorf("missing layer %s", layerPath)
+				}
+				l = NewLayer(c)
+				layers[layerID] = l
+			}
+			img.Layers = append(img.Layers, l)
+		}
+
+		images = append(images, img)
+	}
+
+	return images, nil
+}
+
+func (a *Archive) readOCIImages(spool *Spool) ([]*Image, error) {
+	var (
+		images  []*Image
+		byIndex = map[digest.Digest]*Image{}
+	)
+
+	for _, desc := range a.Index.Manifests {
+		if IsIndex(desc.MediaType) {
+			continue
+		}
+
+		img := byIndex[desc.Digest]
+		if img == nil {
+			var err error
+			img, err = a.readOCIImage(spool, desc)
+			if err != nil {
+				return nil, err
+			}
+			byIndex[desc.Digest] = img
+			images = append(images, img)
+		}
+
+		if name := ImageName(desc); name != "" {
+			img.RepoTags = append(img.RepoTags, name)
+		}
+		img.IndexEntries = append(img.IndexEntries, desc)
+	}
+
+	for _, img := range images {
+		sort.Strings(img.RepoTags)
+	}
+
+	return images, nil
+}
+
+// ReadIndexes returns the multi-platform images contained in the archive.
+// Only the OCI image layout can contain them.
+func (a *Archive) ReadIndexes(spool *Spool) ([]*ImageIndex, error) {
+	if a.Index == nil {
+		return nil, nil
+	}
+
+	var (
+		indexes []*ImageIndex
+		byIndex = map[digest.Digest]*ImageIndex{}
+	)
+
+	for _, desc := range a.Index.Manifests {
+		if !IsIndex(desc.MediaType) {
+			continue
+		}
+
+		idx := byIndex[desc.Digest]
+		if idx == nil {
+			data, err := a.readBlob(desc.Digest)
+			if err != nil {
+				return nil, err
+			}
+
+			var index Index
+			err = json.Unmarshal(data, &index)
+			if err != nil {
+				return nil, err
+			}
+
+			idx = &ImageIndex{Manifest: data, ManifestMediaType: desc.MediaType}
+			for _, imgDesc := range index.Manifests {
+				img, err := a.readOCIImage(spool, imgDesc)
+				if err != nil {
+					return nil, err
+				}
+				idx.Images = append(idx.Images, img)
+			}
+
+			byIndex[desc.Digest] = idx
+			indexes = append(indexes, idx)
+		}
+
+		if name := ImageName(desc); name != "" {
+			idx.RepoTags = append(idx.RepoTags, name)
+		}
+		idx.IndexEntries = append(idx.IndexEntries, desc)
+	}
+
+	for _, idx := range indexes {
+		sort.Strings(idx.RepoTags)
+	}
+
+	return indexes, nil
+}
+
+// IsIndex reports whether a media type is an image index or manifest list.
+func IsIndex(mediaType string) bool {
+	return mediaType == MediaTypeOCIIndex || mediaType == MediaTypeManifestList
+}
+
+func (a *Archive) readOCIImage(spool *Spool, desc Descriptor) (*Image, error) {
+	data, err := a.readBlob(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	var mani Manifest
+	err = json.Unmarshal(data, &mani)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := a.readBlob(mani.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	img := &Image{
+		Config:            config,
+		Manifest:          data,
+		ManifestMediaType: desc.MediaType,
+		Platform:          desc.Platform,
+	}
+
+	if a.layers == nil {
+		a.layers = map[digest.Digest]*Layer{}
+	}
+	for _, layerDesc := range mani.Layers {
+		l := a.layers[layerDesc.Digest]
+		if l == nil {
+			l, err = a.readOCILayer(spool, layerDesc)
+			if err != nil {
+				return nil, err
+			}
+			a.layers[layerDesc.Digest] = l
+		}
+		img.Layers = append(img.Layers, l)
+	}
+
+	return img, nil
+}
+
+func (a *Archive) readBlob(d digest.Digest) ([]byte, error) {
+	c, ok := a.Blobs[d]
+	if !ok {
+		return nil, fmt.Errorf("missing blob %s", d)
+	}
+	return c.ReadAll()
+}
+
+func (a *Archive) readOCILayer(spool *Spool, desc Descriptor) (*Layer, error) {
+	c, ok := a.Blobs[desc.Digest]
+	if !ok {
+		return nil, fmt.Errorf("missing blob %s", desc.Digest)
+	}
+
+	return DecodeLayer(spool, desc.MediaType, c)
+}
+
+// DecodeLayer decompresses a layer blob of the given media type into the
+// spool. Layers are plain or gzipped tars; other compressions, like zstd,
+// are rejected.
+func DecodeLayer(spool *Spool, mediaType string, blob *Content) (*Layer, error) {
+	switch {
+	case strings.HasSuffix(mediaType, "gzip"):
+	case mediaType == "" || strings.HasSuffix(mediaType, ".tar"):
+		return NewLayer(blob), nil
+	default:
+		return nil, fmt.Errorf("unsupported layer media type %s (only tar and gzipped tar layers are supported)", mediaType)
+	}
+
+	r, err := blob.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	c, err := spool.Copy(zr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := NewLayer(c)
+	l.Blob = blob
+	return l, nil
+}
@@ -0,0 +1,243 @@
+package dkrarchive
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/docker/distribution/digest"
+)
+
+// Media types of manifests, configs and layers.
+const (
+	MediaTypeManifestV1    = "application/vnd.docker.distribution.manifest.v1+json"
+	MediaTypeManifestV1Sig = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+	MediaTypeManifestV2    = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeManifestList  = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeConfig        = "application/vnd.docker.container.image.v1+json"
+	MediaTypeLayer         = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+
+	MediaTypeOCIIndex    = "application/vnd.oci.image.index.v1+json"
+	MediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIConfig   = "application/vnd.oci.image.config.v1+json"
+	MediaTypeOCILayer    = "application/vnd.oci.image.layer.v1.tar+gzip"
+)
+
+// PushManifest is the manifest of an image as it is pushed to a registry,
+// together with the blobs it refers to.
+type PushManifest struct {
+	MediaType string
+	Data      []byte
+	Digest    digest.Digest
+	Config    *Blob
+	Layers    []*Blob
+}
+
+// Blob is the content of a descriptor.
+type Blob struct {
+	Descriptor
+	Content *Content
+}
+
+// manifestV2 and descriptorV2 keep the field order docker uses for schema 2
+// manifests so that the manifest digests match.
+type manifestV2 struct {
+	SchemaVersion int            `json:"schemaVersion"`
+	MediaType     string         `json:"mediaType"`
+	Config        descriptorV2   `json:"config"`
+	Layers        []descriptorV2 `json:"layers"`
+}
+
+type descriptorV2 struct {
+	MediaType string        `json:"mediaType"`
+	Size      int64         `json:"size"`
+	Digest    digest.Digest `json:"digest"`
+}
+
+// PushManifest returns the manifest for pushing the image. Images read from
+// an OCI image layout keep their original manifest, all other images get a
+// schema 2 manifest with layers gzipped into the spool.
+func (img *Image) PushManifest(spool *Spool) (*PushManifest, error) {
+	if img.Manifest != nil {
+		return img.originalManifest()
+	}
+
+	config := Bytes(img.Config)
+	pm := &PushManifest{
+		MediaType: MediaTypeManifestV2,
+		Config:    &Blob{newDescriptor(MediaTypeConfig, config), config},
+	}
+
+	mani := &manifestV2{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeManifestV2,
+		Config:        pm.Config.descriptorV2(),
+	}
+
+	for _, l := range img.Layers {
+		blob, err := l.gzipped(spool)
+		if err != nil {
+			return nil, err
+		}
+
+		b := &Blob{newDescriptor(MediaTypeLayer, blob), blob}
+		pm.Layers = append(pm.Layers, b)
+		mani.Layers = append(mani.Layers, b.descriptorV2())
+	}
+
+	data, err := json.Marshal(mani)
+	if err != nil {
+		return nil, err
+	}
+
+	pm.Data = data
+	pm.Digest = Bytes(data).Digest
+
+	return pm, nil
+}
+
+func (img *Image) originalManifest() (*PushManifest, error) {
+	var mani Manifest
+	err := json.Unmarshal(img.Manifest, &mani)
+	if err != nil {
+		return nil, err
+	}
+	if len(mani.Layers) != len(img.Layers) {
+		return nil, fmt.Errorf("manifest has %d layers, image has %d", len(mani.Layers), len(img.Layers))
+	}
+
+	pm := &PushManifest{
+		MediaType: img.ManifestMediaType,
+		Data:      img.Manifest,
+		Digest:    Bytes(img.Manifest).Digest,
+		Config:    &Blob{mani.Config, Bytes(img.Config)},
+	}
+	if pm.MediaType == "" {
+		pm.MediaType = mani.MediaType
+	}
+	if pm.MediaType == "" {
+		pm.MediaType = MediaTypeOCIManifest
+	}
+
+	for i, desc := range mani.Layers {
+		data := img.Layers[i].Blob
+		if data == nil {
+			data = img.Layers[i].Tar
+		}
+		pm.Layers = append(pm.Layers, &Blob{desc, data})
+	}
+
+	return pm, nil
+}
+
+func (b *Blob) descriptorV2() descriptorV2 {
+	return descriptorV2{
+		MediaType: b.MediaType,
+		Size:      b.Size,
+		Digest:    b.Digest,
+	}
+}
+
+// manifestListV2 and platformDescriptorV2 keep the field order docker uses
+// for manifest lists.
+type manifestListV2 struct {
+	SchemaVersion int                    `json:"schemaVersion"`
+	MediaType     string                 `json:"mediaType"`
+	Manifests     []platformDescriptorV2 `json:"manifests"`
+}
+
+type platformDescriptorV2 struct {
+	descriptorV2
+	Platform *Platform `json:"platform"`
+}
+
+// PushManifest returns the manifests for pushing a multi-platform image:
+// the index itself and the manifests of its images, which must be pushed
+// first. Indexes read from an OCI image layout keep their original index.
+// Otherwise images with schema 2 manifests get a manifest list and all
+// others an OCI image index.
+func (idx *ImageIndex) PushManifest(spool *Spool) (*PushManifest, []*PushManifest, error) {
+	var (
+		images  []*PushManifest
+		schema2 = true
+		index   = &ociIndex{SchemaVersion: 2, MediaType: MediaTypeOCIIndex}
+		list    = &manifestListV2{SchemaVersion: 2, MediaType: MediaTypeManifestList}
+	)
+
+	for _, img := range idx.Images {
+		if img.Platform == nil {
+			return nil, nil, errors.New("image in index has no platform")
+		}
+
+		pm, err := img.PushManifest(spool)
+		if err != nil {
+			return nil, nil, err
+		}
+		images = append(images, pm)
+
+		desc := Descriptor{
+			MediaType: pm.MediaType,
+			Digest:    pm.Digest,
+			Size:      int64(len(pm.Data)),
+			Platform:  img.Platform,
+		}
+		index.Manifests = append(index.Manifests, desc)
+		list.Manifests = append(list.Manifests, platformDescriptorV2{
+			descriptorV2: descriptorV2{MediaType: desc.MediaType, Size: desc.Size, Digest: desc.Digest},
+			Platform:     desc.Platform,
+		})
+		if pm.MediaType != MediaTypeManifestV2 {
+			schema2 = false
+		}
+	}
+
+	if idx.Manifest != nil {
+		mediaType := idx.ManifestMediaType
+		if mediaType == "" {
+			mediaType = MediaTypeOCIIndex
+		}
+		return &PushManifest{MediaType: mediaType, Data: idx.Manifest, Digest: Bytes(idx.Manifest).Digest}, images, nil
+	}
+
+	var (
+		pm   = &PushManifest{MediaType: MediaTypeOCIIndex}
+		data []byte
+		err  error
+	)
+	if schema2 {
+		pm.MediaType = MediaTypeManifestList
+		data, err = json.Marshal(list)
+	} else {
+		data, err = json.Marshal(index)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pm.Data = data
+	pm.Digest = Bytes(data).Digest
+	return pm, images, nil
+}
+
+// ParsePlatform parses a platform in the os/arch[/variant] form.
+func ParsePlatform(s string) (*Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid platform %q (expected os/arch[/variant])", s)
+	}
+
+	p := &Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+func (p *Platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
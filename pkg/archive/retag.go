@@ -0,0 +1,159 @@
+package dkrarchive
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+
+	"github.com/docker/distribution/digest"
+)
+
+// Retag copies an archive to dst and only changes the repo tags of its
+// images; layers and blobs are copied as they are. retag is called once
+// with the current tags of every image (in archive order) and returns
+// their new tags.
+func Retag(dst io.Writer, src io.Reader, retag func(tags [][]string) ([][]string, error)) error {
+	r := tar.NewReader(src)
+	w := tar.NewWriter(dst)
+
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if hdr.Name != "manifest.json" && hdr.Name != "index.json" {
+			err = w.WriteHeader(hdr)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(w, r)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+
+		if hdr.Name == "manifest.json" {
+			data, err = retagManifest(data, retag)
+		} else {
+			data, err = retagIndex(data, retag)
+		}
+		if err != nil {
+			return err
+		}
+
+		hdr.Size = int64(len(data))
+		err = w.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return w.Close()
+}
+
+func retagManifest(data []byte, retag func([][]string) ([][]string, error)) ([]byte, error) {
+	var manifest []ManifestEntry
+	err := json.Unmarshal(data, &manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make([][]string, len(manifest))
+	for i, e := range manifest {
+		tags[i] = e.RepoTags
+	}
+
+	tags, err = retag(tags)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range manifest {
+		manifest[i].RepoTags = tags[i]
+	}
+
+	return json.Marshal(&manifest)
+}
+
+// retagIndex rewrites the entries of index.json. The entries of an image
+// are grouped by digest; every new tag gets its own entry.
+func retagIndex(data []byte, retag func([][]string) ([][]string, error)) ([]byte, error) {
+	var index ociIndex
+	err := json.Unmarshal(data, &index)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		descs   []Descriptor
+		tags    [][]string
+		byIndex = map[digest.Digest]int{}
+	)
+	for _, desc := range index.Manifests {
+		i, ok := byIndex[desc.Digest]
+		if !ok {
+			i = len(descs)
+			byIndex[desc.Digest] = i
+			descs = append(descs, untagged(desc))
+			tags = append(tags, nil)
+		}
+		if name := ImageName(desc); name != "" {
+			tags[i] = append(tags[i], name)
+		}
+	}
+
+	tags, err = retag(tags)
+	if err != nil {
+		return nil, err
+	}
+
+	index.Manifests = nil
+	for i, desc := range descs {
+		for _, name := range tags[i] {
+			ref := desc
+			ref.Annotations = map[string]string{}
+			for k, v := range desc.Annotations {
+				ref.Annotations[k] = v
+			}
+			ref.Annotations[AnnotationRefName] = refName(name)
+			ref.Annotations[AnnotationImageName] = name
+			index.Manifests = append(index.Manifests, ref)
+		}
+		if len(tags[i]) == 0 {
+			index.Manifests = append(index.Manifests, desc)
+		}
+	}
+
+	return json.Marshal(&index)
+}
+
+// untagged returns desc without the annotations that name it.
+func untagged(desc Descriptor) Descriptor {
+	var annotations map[string]string
+	for k, v := range desc.Annotations {
+		if k == AnnotationRefName || k == AnnotationImageName {
+			continue
+		}
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[k] = v
+	}
+	desc.Annotations = annotations
+	return desc
+}
@@ -0,0 +1,171 @@
+package dkrarchive
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/docker/distribution/digest"
+)
+
+// Spool stores layers and blobs in temporary files so that images don't
+// have to be held in memory.
+type Spool struct {
+	dir string
+}
+
+// NewSpool creates a spool in a new temporary directory.
+func NewSpool() (*Spool, error) {
+	dir, err := ioutil.TempDir("", "dkr-")
+	if err != nil {
+		return nil, err
+	}
+	return &Spool{dir: dir}, nil
+}
+
+// Close removes all the files in the spool.
+func (s *Spool) Close() error {
+	return os.RemoveAll(s.dir)
+}
+
+// Create returns a writer for a new spool file.
+func (s *Spool) Create() (*ContentWriter, error) {
+	f, err := ioutil.TempFile(s.dir, "blob-")
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	return &ContentWriter{f: f, h: h, w: io.MultiWriter(f, h)}, nil
+}
+
+// Copy stores the content of r in a new spool file.
+func (s *Spool) Copy(r io.Reader) (*Content, error) {
+	w, err := s.Create()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.Copy(w, r)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	return w.Content()
+}
+
+// ContentWriter writes a spool file while computing its digest.
+type ContentWriter struct {
+	f    *os.File
+	h    hash.Hash
+	w    io.Writer
+	size int64
+}
+
+func (w *ContentWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Close closes and removes the spool file without returning its content.
+func (w *ContentWriter) Close() error {
+	w.f.Close()
+	return os.Remove(w.f.Name())
+}
+
+// Content closes the spool file and returns its content.
+func (w *ContentWriter) Content() (*Content, error) {
+	err := w.f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Content{
+		Size:   w.size,
+		Digest: digest.NewDigestFromHex("sha256", hex.EncodeToString(w.h.Sum(nil))),
+		path:   w.f.Name(),
+	}, nil
+}
+
+// Content is data held either in memory or in a spool file.
+type Content struct {
+	Size   int64
+	Digest digest.Digest
+
+	path string
+	data []byte
+}
+
+// Bytes returns in-memory content.
+func Bytes(data []byte) *Content {
+	sum := sha256.Sum256(data)
+	return &Content{
+		Size:   int64(len(data)),
+		Digest: digest.NewDigestFromHex("sha256", hex.EncodeToString(sum[:])),
+		data:   data,
+	}
+}
+
+// ContentReader reads content. It can be read concurrently with ReadAt.
+type ContentReader struct {
+	*io.SectionReader
+	f *os.File
+}
+
+// Open returns a reader for the content.
+func (c *Content) Open() (*ContentReader, error) {
+	if c.path == "" {
+		return &ContentReader{SectionReader: io.NewSectionReader(bytes.NewReader(c.data), 0, c.Size)}, nil
+	}
+
+	f, err := os.Open(c.path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ContentReader{SectionReader: io.NewSectionReader(f, 0, c.Size), f: f}, nil
+}
+
+// OpenRange returns a reader for n bytes of the content starting at off.
+func (c *Content) OpenRange(off, n int64) (*ContentReader, error) {
+	r, err := c.Open()
+	if err != nil {
+		return nil, err
+	}
+
+	r.SectionReader = io.NewSectionReader(r.SectionReader, off, n)
+	return r, nil
+}
+
+func (r *ContentReader) Close() error {
+	if r.f == nil {
+		return nil
+	}
+	return r.f.Close()
+}
+
+// ReadAll returns the content as a byte slice. Only use this for small
+// content like manifests and configs.
+func (c *Content) ReadAll() ([]byte, error) {
+	if c.path == "" {
+		return c.data, nil
+	}
+	return ioutil.ReadFile(c.path)
+}
+
+// WriteTo copies the content to w.
+func (c *Content) WriteTo(w io.Writer) (int64, error) {
+	r, err := c.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	return io.Copy(w, r)
+}
@@ -0,0 +1,336 @@
+package dkrarchive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/docker/distribution/digest"
+)
+
+// Archive formats supported by Write.
+const (
+	// FormatDocker is the layout written by `docker save`.
+	FormatDocker = "docker"
+	// FormatOCI is the OCI image layout.
+	FormatOCI = "oci"
+)
+
+type ociLayout struct {
+	ImageLayoutVersion string `json:"imageLayoutVersion"`
+}
+
+type ociIndex struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+type archiveFile struct {
+	name string
+	data *Content
+}
+
+// Write writes images to dst as an archive in the given format. The repo
+// tags of the images must be normalized. Layers that need to be compressed
+// are compressed into the spool.
+func Write(dst io.Writer, format string, spool *Spool, images ...*Image) error {
+	var (
+		files []archiveFile
+		err   error
+	)
+
+	switch format {
+	case FormatDocker, "":
+		files, err = dockerFiles(images)
+	case FormatOCI:
+		files, err = ociFiles(spool, images, nil)
+	default:
+		return fmt.Errorf("unknown archive format %q", format)
+	}
+	if err != nil {
+		return err
+	}
+
+	return writeFiles(dst, files)
+}
+
+// WriteIndexes writes multi-platform images to dst in the OCI image layout,
+// the only format that can hold them. Each image of an index must have its
+// platform set.
+func WriteIndexes(dst io.Writer, spool *Spool, indexes ...*ImageIndex) error {
+	files, err := ociFiles(spool, nil, indexes)
+	if err != nil {
+		return err
+	}
+
+	return writeFiles(dst, files)
+}
+
+func writeFiles(dst io.Writer, files []archiveFile) error {
+	w := tar.NewWriter(dst)
+	for _, f := range files {
+		err := writeTarFile(w, f.name, f.data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return w.Close()
+}
+
+// ImageID returns the ID of an image in the `docker save` layout.
+func ImageID(config []byte) string {
+	sum := sha256.Sum256(config)
+	return hex.EncodeToString(sum[:])
+}
+
+func dockerFiles(images []*Image) ([]archiveFile, error) {
+	var (
+		manifest []ManifestEntry
+		files    []archiveFile
+		seen     = map[string]bool{}
+	)
+
+	for _, img := range images {
+		imageID := ImageID(img.Config)
+		entry := ManifestEntry{
+			Config:   imageID + ".json",
+			RepoTags: img.RepoTags,
+		}
+
+		if !seen[entry.Config] {
+			seen[entry.Config] = true
+			files = append(files, archiveFile{entry.Config, Bytes(img.Config)})
+		}
+
+		for _, l := range img.Layers {
+			layerPath := l.DiffID + "/layer.tar"
+			entry.Layers = append(entry.Layers, layerPath)
+
+			if seen[layerPath] {
+				continue
+			}
+			seen[layerPath] = true
+			files = append(files,
+				archiveFile{layerPath, l.Tar},
+				archiveFile{l.DiffID + "/VERSION", Bytes([]byte("1.0"))},
+				archiveFile{l.DiffID + "/json", Bytes([]byte("{}"))},
+			)
+		}
+
+		manifest = append(manifest, entry)
+	}
+
+	manifestData, err := json.Marshal(&manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]archiveFile{{"manifest.json", Bytes(manifestData)}}, files...), nil
+}
+
+// ociWriter collects the blobs and index.json entries of an OCI image
+// layout.
+type ociWriter struct {
+	spool *Spool
+	index *ociIndex
+	blobs []archiveFile
+	seen  map[digest.Digest]bool
+}
+
+func ociFiles(spool *Spool, images []*Image, indexes []*ImageIndex) ([]archiveFile, error) {
+	w := &ociWriter{
+		spool: spool,
+		index: &ociIndex{SchemaVersion: 2, MediaType: MediaTypeOCIIndex},
+		seen:  map[digest.Digest]bool{},
+	}
+
+	for _, img := range images {
+		desc, err := w.addImage(img)
+		if err != nil {
+			return nil, err
+		}
+		w.addRefs(desc, img.RepoTags)
+	}
+
+	for _, idx := range indexes {
+		desc, err := w.addIndex(idx)
+		if err != nil {
+			return nil, err
+		}
+		w.addRefs(desc, idx.RepoTags)
+	}
+
+	indexData, err := json.Marshal(w.index)
+	if err != nil {
+		return nil, err
+	}
+
+	layoutData, err := json.Marshal(&ociLayout{ImageLayoutVersion: "1.0.0"})
+	if err != nil {
+		return nil, err
+	}
+
+	files := []archiveFile{
+		{"blobs/", nil},
+		{"blobs/sha256/", nil},
+		{"oci-layout", Bytes(layoutData)},
+		{"index.json", Bytes(indexData)},
+	}
+
+	return append(files, w.blobs...), nil
+}
+
+func (w *ociWriter) addBlob(mediaType string, data *Content) Descriptor {
+	desc := newDescriptor(mediaType, data)
+	if !w.seen[desc.Digest] {
+		w.seen[desc.Digest] = true
+		w.blobs = append(w.blobs, archiveFile{blobPath(desc.Digest), data})
+	}
+	return desc
+}
+
+// addImage adds the blobs of an image and returns the descriptor of its
+// manifest.
+func (w *ociWriter) addImage(img *Image) (Descriptor, error) {
+	mani := &Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIManifest,
+		Config:        w.addBlob(MediaTypeOCIConfig, Bytes(img.Config)),
+	}
+
+	for _, l := range img.Layers {
+		blob, err := l.gzipped(w.spool)
+		if err != nil {
+			return Descriptor{}, err
+		}
+		mani.Layers = append(mani.Layers, w.addBlob(MediaTypeOCILayer, blob))
+	}
+
+	maniData, err := json.Marshal(mani)
+	if err != nil {
+		return Descriptor{}, err
+	}
+
+	desc := w.addBlob(MediaTypeOCIManifest, Bytes(maniData))
+	desc.Platform = img.Platform
+	return desc, nil
+}
+
+// addIndex adds the images of an image index and returns the descriptor
+// of the index.
+func (w *ociWriter) addIndex(idx *ImageIndex) (Descriptor, error) {
+	index := &ociIndex{SchemaVersion: 2, MediaType: MediaTypeOCIIndex}
+	for _, img := range idx.Images {
+		desc, err := w.addImage(img)
+		if err != nil {
+			return Descriptor{}, err
+		}
+		index.Manifests = append(index.Manifests, desc)
+	}
+
+	indexData, err := json.Marshal(index)
+	if err != nil {
+		return Descriptor{}, err
+	}
+
+	return w.addBlob(MediaTypeOCIIndex, Bytes(indexData)), nil
+}
+
+// addRefs adds an index.json entry for every name, or a single entry
+// without annotations when there are no names.
+func (w *ociWriter) addRefs(desc Descriptor, names []string) {
+	desc.Platform = nil
+
+	for _, name := range names {
+		ref := desc
+		ref.Annotations = map[string]string{
+			AnnotationRefName:   refName(name),
+			AnnotationImageName: name,
+		}
+		w.index.Manifests = append(w.index.Manifests, ref)
+	}
+	if len(names) == 0 {
+		w.index.Manifests = append(w.index.Manifests, desc)
+	}
+}
+
+// gzipped returns the compressed layer, reusing the original blob when
+// the layer came from a registry or OCI layout. The layer is compressed
+// only once, later calls return the same blob.
+func (l *Layer) gzipped(spool *Spool) (*Content, error) {
+	if l.Blob != nil {
+		return l.Blob, nil
+	}
+
+	w, err := spool.Create()
+	if err != nil {
+		return nil, err
+	}
+	zw := gzip.NewWriter(w)
+	_, err = l.Tar.WriteTo(zw)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	err = zw.Close()
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	l.Blob, err = w.Content()
+	if err != nil {
+		return nil, err
+	}
+	return l.Blob, nil
+}
+
+// refName returns the tag of a normalized image reference.
+func refName(name string) string {
+	if idx := strings.LastIndex(name, ":"); idx > strings.LastIndex(name, "/") {
+		return name[idx+1:]
+	}
+	return "latest"
+}
+
+func newDescriptor(mediaType string, data *Content) Descriptor {
+	return Descriptor{
+		MediaType: mediaType,
+		Digest:    data.Digest,
+		Size:      data.Size,
+	}
+}
+
+func blobPath(d digest.Digest) string {
+	return "blobs/" + string(d.Algorithm()) + "/" + d.Hex()
+}
+
+func writeTarFile(w *tar.Writer, name string, data *Content) error {
+	hdr := &tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+	}
+	if strings.HasSuffix(name, "/") {
+		hdr.Typeflag = tar.TypeDir
+		hdr.Mode = 0755
+	}
+	if data != nil {
+		hdr.Size = data.Size
+	}
+
+	err := w.WriteHeader(hdr)
+	if err != nil || data == nil {
+		return err
+	}
+
+	_, err = data.WriteTo(w)
+	return err
+}
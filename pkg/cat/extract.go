@@ -0,0 +1,84 @@
+package dkrcat
+
+import (
+	"archive/tar"
+	"io"
+	"strings"
+
+	"github.com/fd/dkr-util/pkg/archive"
+)
+
+// Extract writes a file from the merged filesystem of an image to dst. When
+// name is not a regular file it is written as a tar of the subtree instead.
+func Extract(dst io.Writer, src io.Reader, image, platform, name string) error {
+	spool, err := dkrarchive.NewSpool()
+	if err != nil {
+		return err
+	}
+	defer spool.Close()
+
+	img, err := selectImage(src, spool, image, platform)
+	if err != nil {
+		return err
+	}
+
+	fs, err := mergeLayers(img)
+	if err != nil {
+		return err
+	}
+
+	entries, err := fs.walk(name)
+	if err != nil {
+		return err
+	}
+
+	if e := fs.resolveLink(entries[0]); e.hdr.Typeflag == tar.TypeReg || e.hdr.Typeflag == tar.TypeRegA {
+		return e.writeData(dst)
+	}
+
+	w := tar.NewWriter(dst)
+	for _, e := range entries {
+		hdr := *e.hdr
+		hdr.Name = strings.TrimPrefix(hdr.Name, "/")
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Name += "/"
+		}
+		if hdr.Name == "/" {
+			continue
+		}
+
+		// hard links may point outside of the extracted subtree
+		data := e
+		if hdr.Typeflag == tar.TypeLink {
+			data = fs.resolveLink(e)
+			hdr.Typeflag = tar.TypeReg
+			hdr.Linkname = ""
+			hdr.Size = data.hdr.Size
+		}
+
+		err = w.WriteHeader(&hdr)
+		if err != nil {
+			return err
+		}
+		if data.hdr.Size == 0 {
+			continue
+		}
+		err = data.writeData(w)
+		if err != nil {
+			return err
+		}
+	}
+
+	return w.Close()
+}
+
+// resolveLink returns the target of a hard link, or e itself.
+func (fs mergedFS) resolveLink(e *fsEntry) *fsEntry {
+	if e.hdr.Typeflag != tar.TypeLink {
+		return e
+	}
+	if target, ok := fs[e.hdr.Linkname]; ok {
+		return target
+	}
+	return e
+}
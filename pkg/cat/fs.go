@@ -0,0 +1,261 @@
+package dkrcat
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/fd/dkr-util/pkg/archive"
+	"github.com/fd/dkr-util/pkg/registry"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// fsEntry is a file in the merged filesystem. Its data is read on demand
+// from the layer tar it was found in.
+type fsEntry struct {
+	hdr    *tar.Header
+	layer  int
+	tar    *dkrarchive.Content
+	offset int64
+}
+
+// mergedFS is the filesystem of an image after applying all its layers.
+// Paths are absolute and cleaned.
+type mergedFS map[string]*fsEntry
+
+// selectImage returns the image with the given repo tag, or the only image in
+// the archive when name is empty. The images of multi-platform images are
+// narrowed down by platform (os/arch[/variant]).
+func selectImage(src io.Reader, spool *dkrarchive.Spool, name, platform string) (*dkrarchive.Image, error) {
+	a, err := dkrarchive.Read(src, spool)
+	if err != nil {
+		return nil, err
+	}
+
+	images, err := a.ReadImages(spool)
+	if err != nil {
+		return nil, err
+	}
+
+	indexes, err := a.ReadIndexes(spool)
+	if err != nil {
+		return nil, err
+	}
+
+	type candidate struct {
+		img  *dkrarchive.Image
+		tags []string
+	}
+
+	var candidates []candidate
+	for _, img := range images {
+		candidates = append(candidates, candidate{img, img.RepoTags})
+	}
+	for _, idx := range indexes {
+		for _, img := range idx.Images {
+			candidates = append(candidates, candidate{img, idx.RepoTags})
+		}
+	}
+
+	var found []*dkrarchive.Image
+	if name != "" {
+		name = dkrregistry.ParseRef(name).String()
+	}
+	for _, c := range candidates {
+		if platform != "" && (c.img.Platform == nil || c.img.Platform.String() != platform) {
+			continue
+		}
+		if name == "" {
+			found = append(found, c.img)
+			continue
+		}
+		for _, tag := range c.tags {
+			if dkrregistry.ParseRef(tag).String() == name {
+				found = append(found, c.img)
+				break
+			}
+		}
+	}
+
+	switch {
+	case len(found) == 1:
+		return found[0], nil
+	case len(found) > 1 && platform == "" && name != "":
+		return nil, fmt.Errorf("image %s has %d platforms, select one with --platform", name, len(found))
+	case len(found) > 1:
+		return nil, fmt.Errorf("archive contains %d images, select one with --image or --platform", len(found))
+	case name != "":
+		return nil, fmt.Errorf("image %s not found", name)
+	default:
+		return nil, fmt.Errorf("archive contains no image for platform %s", platform)
+	}
+}
+
+// mergeLayers applies the layers of an image from bottom to top, honoring
+// whiteouts and opaque directories.
+func mergeLayers(img *dkrarchive.Image) (mergedFS, error) {
+	fs := mergedFS{"/": {hdr: &tar.Header{Name: "/", Typeflag: tar.TypeDir, Mode: 0755}}}
+	idx := &fsIndex{names: []string{"/"}}
+
+	for i, l := range img.Layers {
+		err := fs.mergeLayer(idx, i, l.Tar)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return fs, nil
+}
+
+func (fs mergedFS) mergeLayer(idx *fsIndex, i int, layer *dkrarchive.Content) error {
+	lr, err := layer.Open()
+	if err != nil {
+		return err
+	}
+	defer lr.Close()
+
+	cr := &countingReader{r: lr}
+	r := tar.NewReader(cr)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := path.Join("/", hdr.Name)
+		dir, base := path.Split(name)
+
+		if base == whiteoutOpaque {
+			fs.removeBelow(idx, path.Clean(dir), i)
+			continue
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			target := path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+			if old, ok := fs[target]; ok {
+				delete(fs, target)
+				if old.hdr.Typeflag == tar.TypeDir {
+					fs.removeBelow(idx, target, i+1)
+				}
+			}
+			continue
+		}
+
+		// only a directory has entries to remove
+		if old, ok := fs[name]; ok {
+			if old.hdr.Typeflag == tar.TypeDir && hdr.Typeflag != tar.TypeDir {
+				fs.removeBelow(idx, name, i)
+			}
+		} else {
+			idx.add(name)
+		}
+		if hdr.Linkname != "" && hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = path.Join("/", hdr.Linkname)
+		}
+
+		hdr.Name = name
+		// the tar reader doesn't read ahead, so the data of the entry
+		// starts right after its header
+		fs[name] = &fsEntry{hdr: hdr, layer: i, tar: layer, offset: cr.n}
+	}
+}
+
+// removeBelow removes all entries inside dir that come from layers below
+// layer.
+func (fs mergedFS) removeBelow(idx *fsIndex, dir string, layer int) {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	names := idx.sortedNames(fs)
+	for j := sort.SearchStrings(names, prefix); j < len(names) && strings.HasPrefix(names[j], prefix); j++ {
+		if e, ok := fs[names[j]]; ok && e.layer < layer {
+			delete(fs, names[j])
+		}
+	}
+}
+
+// fsIndex keeps the paths of a mergedFS sorted, so the entries inside a
+// directory are found without scanning all entries. Paths are sorted
+// when the index is used after paths were added.
+type fsIndex struct {
+	names []string
+	dirty bool
+}
+
+func (idx *fsIndex) add(name string) {
+	idx.names = append(idx.names, name)
+	idx.dirty = true
+}
+
+// sortedNames returns the sorted paths, dropping the ones that were
+// removed from fs.
+func (idx *fsIndex) sortedNames(fs mergedFS) []string {
+	if !idx.dirty {
+		return idx.names
+	}
+
+	sort.Strings(idx.names)
+	names := idx.names[:0]
+	for _, name := range idx.names {
+		if _, ok := fs[name]; ok && (len(names) == 0 || names[len(names)-1] != name) {
+			names = append(names, name)
+		}
+	}
+	idx.names, idx.dirty = names, false
+	return names
+}
+
+// walk returns the entries at and below root, sorted by path.
+func (fs mergedFS) walk(root string) ([]*fsEntry, error) {
+	root = path.Join("/", root)
+	if _, ok := fs[root]; !ok {
+		return nil, fmt.Errorf("%s: no such file or directory", root)
+	}
+
+	prefix := strings.TrimSuffix(root, "/") + "/"
+
+	var names []string
+	for name := range fs {
+		if name == root || strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	entries := make([]*fsEntry, len(names))
+	for i, name := range names {
+		entries[i] = fs[name]
+	}
+
+	return entries, nil
+}
+
+// writeData copies the data of a regular file to w.
+func (e *fsEntry) writeData(w io.Writer) error {
+	r, err := e.tar.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	_, err = io.Copy(w, io.NewSectionReader(r, e.offset, e.hdr.Size))
+	return err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
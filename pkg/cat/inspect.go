@@ -0,0 +1,211 @@
+package dkrcat
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/fd/dkr-util/pkg/archive"
+	"github.com/fd/dkr-util/pkg/registry"
+)
+
+type imageInfo struct {
+	RepoTags      []string                  `json:"repo_tags"`
+	ManifestEntry *dkrarchive.ManifestEntry `json:"manifest_entry,omitempty"`
+	IndexEntries  []dkrarchive.Descriptor   `json:"index_entries,omitempty"`
+
+	ConfigDigest string          `json:"config_digest"`
+	Created      string          `json:"created"`
+	Author       string          `json:"author,omitempty"`
+	Architecture string          `json:"architecture"`
+	OS           string          `json:"os"`
+	Variant      string          `json:"variant,omitempty"`
+	Config       json.RawMessage `json:"config"`
+	DiffIDs      []string        `json:"diff_ids"`
+	History      json.RawMessage `json:"history"`
+	Layers       []layerInfo     `json:"layers"`
+
+	ManifestMediaType string   `json:"manifest_media_type"`
+	ManifestDigest    string   `json:"manifest_digest"`
+	PushRefs          []string `json:"push_refs"`
+}
+
+// indexInfo describes a multi-platform image. Manifests holds one imageInfo
+// per platform.
+type indexInfo struct {
+	RepoTags     []string                `json:"repo_tags"`
+	IndexEntries []dkrarchive.Descriptor `json:"index_entries,omitempty"`
+
+	ManifestMediaType string       `json:"manifest_media_type"`
+	ManifestDigest    string       `json:"manifest_digest"`
+	PushRefs          []string     `json:"push_refs"`
+	Manifests         []*imageInfo `json:"manifests"`
+}
+
+type layerInfo struct {
+	DiffID         string `json:"diff_id"`
+	Size           int64  `json:"size"`
+	Digest         string `json:"digest"`
+	CompressedSize int64  `json:"compressed_size"`
+	MediaType      string `json:"media_type"`
+}
+
+type imageConfig struct {
+	Created      string          `json:"created"`
+	Author       string          `json:"author"`
+	Architecture string          `json:"architecture"`
+	OS           string          `json:"os"`
+	Variant      string          `json:"variant"`
+	Config       json.RawMessage `json:"config"`
+	RootFS       struct {
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+	History json.RawMessage `json:"history"`
+}
+
+// Inspect prints the metadata of all images in an archive as JSON. This
+// includes the manifest digests the images get when they are pushed.
+// Multi-platform images are listed after the other images with the
+// metadata of each platform under "manifests".
+func Inspect(dst io.Writer, src io.Reader) error {
+	spool, err := dkrarchive.NewSpool()
+	if err != nil {
+		return err
+	}
+	defer spool.Close()
+
+	a, err := dkrarchive.Read(src, spool)
+	if err != nil {
+		return err
+	}
+
+	images, err := a.ReadImages(spool)
+	if err != nil {
+		return err
+	}
+
+	indexes, err := a.ReadIndexes(spool)
+	if err != nil {
+		return err
+	}
+
+	infos := []interface{}{}
+	for _, img := range images {
+		info, err := inspectImage(spool, img)
+		if err != nil {
+			return err
+		}
+		infos = append(infos, info)
+	}
+	for _, idx := range indexes {
+		info, err := inspectIndex(spool, idx)
+		if err != nil {
+			return err
+		}
+		infos = append(infos, info)
+	}
+
+	data, err := json.MarshalIndent(infos, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(dst, "%s\n", data)
+	return err
+}
+
+func inspectImage(spool *dkrarchive.Spool, img *dkrarchive.Image) (*imageInfo, error) {
+	var conf imageConfig
+	err := json.Unmarshal(img.Config, &conf)
+	if err != nil {
+		return nil, err
+	}
+
+	mani, err := img.PushManifest(spool)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &imageInfo{
+		RepoTags:      img.RepoTags,
+		ManifestEntry: img.ManifestEntry,
+		IndexEntries:  img.IndexEntries,
+
+		ConfigDigest: mani.Config.Digest.String(),
+		Created:      conf.Created,
+		Author:       conf.Author,
+		Architecture: conf.Architecture,
+		OS:           conf.OS,
+		Variant:      conf.Variant,
+		Config:       conf.Config,
+		DiffIDs:      conf.RootFS.DiffIDs,
+		History:      conf.History,
+
+		ManifestMediaType: mani.MediaType,
+		ManifestDigest:    mani.Digest.String(),
+	}
+	if info.RepoTags == nil {
+		info.RepoTags = []string{}
+	}
+
+	for i, l := range img.Layers {
+		info.Layers = append(info.Layers, layerInfo{
+			DiffID:         "sha256:" + l.DiffID,
+			Size:           l.Tar.Size,
+			Digest:         mani.Layers[i].Digest.String(),
+			CompressedSize: mani.Layers[i].Size,
+			MediaType:      mani.Layers[i].MediaType,
+		})
+	}
+
+	info.PushRefs = pushRefs(img.RepoTags, mani.Digest.String())
+
+	return info, nil
+}
+
+func inspectIndex(spool *dkrarchive.Spool, idx *dkrarchive.ImageIndex) (*indexInfo, error) {
+	mani, _, err := idx.PushManifest(spool)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &indexInfo{
+		RepoTags:     idx.RepoTags,
+		IndexEntries: idx.IndexEntries,
+
+		ManifestMediaType: mani.MediaType,
+		ManifestDigest:    mani.Digest.String(),
+		PushRefs:          pushRefs(idx.RepoTags, mani.Digest.String()),
+		Manifests:         []*imageInfo{},
+	}
+	if info.RepoTags == nil {
+		info.RepoTags = []string{}
+	}
+
+	for _, img := range idx.Images {
+		imgInfo, err := inspectImage(spool, img)
+		if err != nil {
+			return nil, err
+		}
+		info.Manifests = append(info.Manifests, imgInfo)
+	}
+
+	return info, nil
+}
+
+// pushRefs returns the by-digest references a manifest gets when it is
+// pushed to the repositories of tags.
+func pushRefs(tags []string, digest string) []string {
+	var (
+		refs = []string{}
+		seen = map[string]bool{}
+	)
+	for _, tag := range tags {
+		pushRef := dkrregistry.ParseRef(tag).Name() + "@" + digest
+		if !seen[pushRef] {
+			seen[pushRef] = true
+			refs = append(refs, pushRef)
+		}
+	}
+	return refs
+}
@@ -0,0 +1,54 @@
+package dkrcat
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+
+	"github.com/fd/dkr-util/pkg/archive"
+)
+
+// List prints the merged filesystem of an image at and below root, one
+// entry per line with its mode, owner, size and link target.
+func List(dst io.Writer, src io.Reader, image, platform, root string) error {
+	spool, err := dkrarchive.NewSpool()
+	if err != nil {
+		return err
+	}
+	defer spool.Close()
+
+	img, err := selectImage(src, spool, image, platform)
+	if err != nil {
+		return err
+	}
+
+	fs, err := mergeLayers(img)
+	if err != nil {
+		return err
+	}
+
+	entries, err := fs.walk(root)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		hdr := e.hdr
+
+		var link string
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			link = " -> " + hdr.Linkname
+		case tar.TypeLink:
+			link = " link to " + hdr.Linkname
+		}
+
+		_, err = fmt.Fprintf(dst, "%s %d/%d %10d %s%s\n",
+			hdr.FileInfo().Mode(), hdr.Uid, hdr.Gid, hdr.Size, hdr.Name, link)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
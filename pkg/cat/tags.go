@@ -1,71 +1,57 @@
 package dkrcat
 
 import (
-	"archive/tar"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"sort"
-)
-
-func Tags(src io.Reader) error {
-	r := tar.NewReader(src)
 
-	for {
-		hdr, err := r.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil
-		}
+	"github.com/fd/dkr-util/pkg/archive"
+)
 
-		if hdr.Name != "manifest.json" {
-			io.Copy(ioutil.Discard, r)
-			continue
-		}
+// Tags prints the tags of the images and multi-platform images in an
+// archive, in either layout.
+func Tags(dst io.Writer, src io.Reader) error {
+	spool, err := dkrarchive.NewSpool()
+	if err != nil {
+		return err
+	}
+	defer spool.Close()
 
-		data, err := ioutil.ReadAll(r)
-		if err != nil {
-			return err
-		}
+	a, err := dkrarchive.Read(src, spool)
+	if err != nil {
+		return err
+	}
 
-		var manifest []manifestEntry
+	images, err := a.ReadImages(spool)
+	if err != nil {
+		return err
+	}
 
-		err = json.Unmarshal(data, &manifest)
-		if err != nil {
-			return err
-		}
+	indexes, err := a.ReadIndexes(spool)
+	if err != nil {
+		return err
+	}
 
-		var tags []string
-		for _, e := range manifest {
-			for _, t := range e.RepoTags {
-				tags = append(tags, t)
-			}
-		}
-		sort.Strings(tags)
-		utags := tags[:0]
-		last := ""
-		for _, t := range tags {
-			if last != t {
-				last = t
-				utags = append(utags, t)
-			}
-		}
+	var tags []string
+	for _, img := range images {
+		tags = append(tags, img.RepoTags...)
+	}
+	for _, idx := range indexes {
+		tags = append(tags, idx.RepoTags...)
+	}
+	if len(tags) == 0 {
+		return errors.New("no tags found")
+	}
 
-		for _, t := range utags {
-			fmt.Println(t)
+	sort.Strings(tags)
+	last := ""
+	for _, t := range tags {
+		if last != t {
+			last = t
+			fmt.Fprintln(dst, t)
 		}
-		return nil
 	}
 
-	return errors.New("no tags found")
-}
-
-type manifestEntry struct {
-	Config   string
-	RepoTags []string
-	Layers   []string
+	return nil
 }
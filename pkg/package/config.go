@@ -0,0 +1,189 @@
+package dkrpackage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// decodeConfig decodes .docker.json on top of conf. Unknown keys are
+// rejected instead of ignored, with a suggestion when they look like a
+// misspelled key.
+func decodeConfig(data []byte, conf *Config) error {
+	var raw interface{}
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return fmt.Errorf("invalid .docker.json: %s", err)
+	}
+	err = checkKeys(raw, reflect.TypeOf(conf), "")
+	if err != nil {
+		return fmt.Errorf("invalid .docker.json: %s", err)
+	}
+
+	err = json.Unmarshal(data, conf)
+	if err != nil {
+		return fmt.Errorf("invalid .docker.json: %s", err)
+	}
+
+	if c := conf.Config; c != nil && c.Healthcheck != nil && len(c.Healthcheck.Test) > 0 {
+		switch c.Healthcheck.Test[0] {
+		case "NONE", "CMD", "CMD-SHELL":
+		default:
+			return fmt.Errorf("invalid .docker.json: health check test must start with NONE, CMD or CMD-SHELL (got %q)", c.Healthcheck.Test[0])
+		}
+	}
+
+	return nil
+}
+
+// checkKeys checks that every key of the decoded JSON value v is a field of
+// the type t it will be decoded into. Keys match fields like they do for
+// json.Unmarshal, ignoring case.
+func checkKeys(v interface{}, t reflect.Type, path string) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch v := v.(type) {
+	case []interface{}:
+		if t.Kind() != reflect.Slice {
+			return nil
+		}
+		for i, elem := range v {
+			err := checkKeys(elem, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return err
+			}
+		}
+
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		if t.Kind() == reflect.Map {
+			for _, key := range keys {
+				err := checkKeys(v[key], t.Elem(), joinKey(path, key))
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if t.Kind() != reflect.Struct {
+			return nil
+		}
+
+		fields := jsonFields(t)
+		for _, key := range keys {
+			f, ok := lookupField(fields, key)
+			if !ok {
+				msg := fmt.Sprintf("unknown key %q", joinKey(path, key))
+				if s := suggestKey(fields, key); s != "" {
+					msg += fmt.Sprintf(" (did you mean %q?)", s)
+				}
+				return errors.New(msg)
+			}
+
+			err := checkKeys(v[key], f.Type, joinKey(path, key))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// jsonFields returns the exported fields of a struct by JSON key.
+func jsonFields(t reflect.Type) map[string]reflect.StructField {
+	fields := map[string]reflect.StructField{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f
+	}
+	return fields
+}
+
+func lookupField(fields map[string]reflect.StructField, key string) (reflect.StructField, bool) {
+	if f, ok := fields[key]; ok {
+		return f, true
+	}
+	for name, f := range fields {
+		if strings.EqualFold(name, key) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// suggestKey returns the key closest to key, or "" when none of them is
+// close.
+func suggestKey(fields map[string]reflect.StructField, key string) string {
+	var (
+		best     string
+		bestDist = len(key)/2 + 1
+	)
+	for name := range fields {
+		d := editDistance(strings.ToLower(key), strings.ToLower(name))
+		if d < bestDist || d == bestDist && name < best {
+			best, bestDist = name, d
+		}
+	}
+	if bestDist > len(key)/2 {
+		return ""
+	}
+	return best
+}
+
+func joinKey(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// editDistance returns the Levenshtein distance of a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if d := prev[j] + 1; d < cur[j] {
+				cur[j] = d
+			}
+			if d := cur[j-1] + 1; d < cur[j] {
+				cur[j] = d
+			}
+		}
+		prev = cur
+	}
+
+	return prev[len(b)]
+}
@@ -0,0 +1,115 @@
+package dkrpackage
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDecodeConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		json     string
+		expected *Config
+		err      string
+	}{
+		{
+			name:     "keys ignore case",
+			json:     `{"Repo_Tags": ["app"], "config": {"entrypoint": ["/app"], "WorkingDir": "/srv"}}`,
+			expected: &Config{RepoTags: []string{"app"}, Config: &ContainerConfig{Entrypoint: []string{"/app"}, WorkingDir: "/srv"}},
+		},
+		{
+			name: "health check durations",
+			json: `{"config": {"Healthcheck": {"Test": ["CMD", "/app", "check"], "Interval": "30s", "Timeout": 5000000000, "Retries": 3}}}`,
+			expected: &Config{Config: &ContainerConfig{Healthcheck: &HealthConfig{
+				Test:     []string{"CMD", "/app", "check"},
+				Interval: Duration(30 * time.Second),
+				Timeout:  Duration(5 * time.Second),
+				Retries:  3,
+			}}},
+		},
+		{
+			name:     "maps of any key",
+			json:     `{"config": {"Labels": {"anything": "goes"}, "ExposedPorts": {"80/tcp": {}}}}`,
+			expected: &Config{Config: &ContainerConfig{Labels: map[string]string{"anything": "goes"}, ExposedPorts: map[string]struct{}{"80/tcp": {}}}},
+		},
+		{
+			name: "unknown key",
+			json: `{"repo_tag": ["app"]}`,
+			err:  `invalid .docker.json: unknown key "repo_tag" (did you mean "repo_tags"?)`,
+		},
+		{
+			name: "unknown key without suggestion",
+			json: `{"unrelated": true}`,
+			err:  `invalid .docker.json: unknown key "unrelated"`,
+		},
+		{
+			name: "unknown nested key",
+			json: `{"files": [{"paths": ["/bin/app"]}, {"paths": ["/bin/sh"], "capabilites": ["cap_chown"]}]}`,
+			err:  `invalid .docker.json: unknown key "files[1].capabilites" (did you mean "capabilities"?)`,
+		},
+		{
+			name: "unknown key of a pointer",
+			json: `{"config": {"Healthcheck": {"Intervall": "1s"}}}`,
+			err:  `invalid .docker.json: unknown key "config.Healthcheck.Intervall" (did you mean "Interval"?)`,
+		},
+		{
+			name: "invalid health check test",
+			json: `{"config": {"Healthcheck": {"Test": ["/app", "check"]}}}`,
+			err:  `invalid .docker.json: health check test must start with NONE, CMD or CMD-SHELL (got "/app")`,
+		},
+		{
+			name: "invalid duration",
+			json: `{"config": {"Healthcheck": {"Interval": true}}}`,
+			err:  `invalid .docker.json: invalid duration true (expected nanoseconds or a string like "30s")`,
+		},
+		{
+			name: "invalid JSON",
+			json: `{"repo_tags": }`,
+			err:  `invalid .docker.json: invalid character '}' looking for beginning of value`,
+		},
+	}
+
+	for _, test := range tests {
+		conf := &Config{}
+		err := decodeConfig([]byte(test.json), conf)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(conf, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.expected, conf)
+		}
+	}
+}
+
+func TestInputConfig(t *testing.T) {
+	input := mkTar(t,
+		testEntry{name: ".docker.json", body: `{"exclude": ["secret"], "ownership": {"owner": "1:1"}}`},
+		testEntry{name: "app", body: "app"},
+		testEntry{name: "secret", body: "secret"},
+	)
+
+	hdrs, err := packageHeaders(t, &Config{}, bytes.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hdrs) != 1 || hdrs["app"] == nil || hdrs["app"].Uid != 1 {
+		t.Errorf("expected only app owned by 1:1, got %v", hdrs)
+	}
+
+	input = mkTar(t, testEntry{name: ".docker.json", body: `{"exlude": ["secret"]}`})
+
+	_, err = packageHeaders(t, &Config{}, bytes.NewReader(input))
+	expected := `invalid .docker.json: unknown key "exlude" (did you mean "exclude"?)`
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected error %q, got %v", expected, err)
+	}
+}
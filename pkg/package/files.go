@@ -0,0 +1,211 @@
+package dkrpackage
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// FileConfig overrides the mode, owner and capabilities of the files
+// matching one of Paths. Paths are globs like the paths of ownership rules.
+// Every matching entry is applied in order, so later entries override the
+// fields set by earlier ones.
+type FileConfig struct {
+	Paths []string `json:"paths"`
+
+	// Mode is the octal permission mode, including the setuid, setgid and
+	// sticky bits (like "4755").
+	Mode string `json:"mode"`
+
+	// Owner is UID:GID or USER:GROUP, like the owners of ownership rules.
+	Owner string `json:"owner"`
+
+	// Capabilities are the Linux file capabilities (like
+	// "cap_net_bind_service") of an executable. They are stored in the
+	// security.capability xattr as permitted and effective capabilities.
+	Capabilities []string `json:"capabilities"`
+}
+
+const xattrCapability = "SCHILY.xattr.security.capability"
+
+// vfs_cap_data as defined in linux/capability.h
+const (
+	vfsCapRevision2      = 0x02000000
+	vfsCapFlagsEffective = 0x000001
+)
+
+var capabilities = map[string]uint{
+	"chown":              0,
+	"dac_override":       1,
+	"dac_read_search":    2,
+	"fowner":             3,
+	"fsetid":             4,
+	"kill":               5,
+	"setgid":             6,
+	"setuid":             7,
+	"setpcap":            8,
+	"linux_immutable":    9,
+	"net_bind_service":   10,
+	"net_broadcast":      11,
+	"net_admin":          12,
+	"net_raw":            13,
+	"ipc_lock":           14,
+	"ipc_owner":          15,
+	"sys_module":         16,
+	"sys_rawio":          17,
+	"sys_chroot":         18,
+	"sys_ptrace":         19,
+	"sys_pacct":          20,
+	"sys_admin":          21,
+	"sys_boot":           22,
+	"sys_nice":           23,
+	"sys_resource":       24,
+	"sys_time":           25,
+	"sys_tty_config":     26,
+	"mknod":              27,
+	"lease":              28,
+	"audit_write":        29,
+	"audit_control":      30,
+	"setfcap":            31,
+	"mac_override":       32,
+	"mac_admin":          33,
+	"syslog":             34,
+	"wake_alarm":         35,
+	"block_suspend":      36,
+	"audit_read":         37,
+	"perfmon":            38,
+	"bpf":                39,
+	"checkpoint_restore": 40,
+}
+
+type fileRule struct {
+	paths      []string
+	mode       int64
+	hasMode    bool
+	owner      *owner
+	capability string
+}
+
+// filePolicy applies the file configs to tar headers.
+type filePolicy struct {
+	rules []fileRule
+}
+
+// newFilePolicy parses the file configs. Owners are resolved against the
+// users and groups of the image.
+func newFilePolicy(confs []FileConfig, db *userDB) (*filePolicy, error) {
+	policy := &filePolicy{}
+
+	for _, conf := range confs {
+		if len(conf.Paths) == 0 {
+			return nil, errors.New("file config without paths")
+		}
+		for _, pattern := range conf.Paths {
+			if !validGlob(pattern) {
+				return nil, fmt.Errorf("invalid path pattern %q", pattern)
+			}
+		}
+
+		rule := fileRule{paths: conf.Paths}
+
+		if conf.Mode != "" {
+			mode, err := strconv.ParseUint(conf.Mode, 8, 32)
+			if err != nil || mode > 07777 {
+				return nil, fmt.Errorf("invalid mode %q for %s", conf.Mode, strings.Join(conf.Paths, ", "))
+			}
+			rule.mode, rule.hasMode = int64(mode), true
+		}
+
+		if conf.Owner == preserveOwner {
+			return nil, fmt.Errorf("invalid owner %q for %s (only valid in ownership)", conf.Owner, strings.Join(conf.Paths, ", "))
+		}
+		if conf.Owner != "" {
+			o, err := db.resolve(conf.Owner)
+			if err != nil {
+				return nil, err
+			}
+			rule.owner = o
+		}
+
+		if len(conf.Capabilities) > 0 {
+			capability, err := capabilityXattr(conf.Capabilities)
+			if err != nil {
+				return nil, err
+			}
+			rule.capability = capability
+		}
+
+		policy.rules = append(policy.rules, rule)
+	}
+
+	return policy, nil
+}
+
+// apply overrides the mode, owner and capabilities of a header. A rule
+// applies when it matches one of names, the paths that share the entry's
+// data through hard links. The mode of symlinks is left alone and
+// capabilities can only be set on regular files.
+func (p *filePolicy) apply(hdr *tar.Header, names []string) error {
+	for _, rule := range p.rules {
+		if !matchesAnyName(names, rule.paths) {
+			continue
+		}
+
+		if rule.hasMode && hdr.Typeflag != tar.TypeSymlink {
+			hdr.Mode = hdr.Mode&^07777 | rule.mode
+		}
+
+		if rule.owner != nil {
+			hdr.Uid = rule.owner.uid
+			hdr.Gid = rule.owner.gid
+			hdr.Uname = rule.owner.uname
+			hdr.Gname = rule.owner.gname
+		}
+
+		if rule.capability != "" {
+			if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+				return fmt.Errorf("capabilities can only be set on regular files: /%s", hdr.Name)
+			}
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = map[string]string{}
+			}
+			hdr.PAXRecords[xattrCapability] = rule.capability
+			hdr.Format = tar.FormatPAX
+		}
+	}
+
+	return nil
+}
+
+func matchesAnyName(names []string, patterns []string) bool {
+	for _, name := range names {
+		if matchesAnyGlob(name, patterns) {
+			return true
+		}
+	}
+	return false
+}
+
+// capabilityXattr encodes capabilities as a version 2 security.capability
+// xattr with the capabilities permitted and effective.
+func capabilityXattr(names []string) (string, error) {
+	var permitted [2]uint32
+	for _, name := range names {
+		c, ok := capabilities[strings.TrimPrefix(strings.ToLower(name), "cap_")]
+		if !ok {
+			return "", fmt.Errorf("unknown capability %q", name)
+		}
+		permitted[c/32] |= 1 << (c % 32)
+	}
+
+	data := make([]byte, 20)
+	binary.LittleEndian.PutUint32(data[0:], vfsCapRevision2|vfsCapFlagsEffective)
+	binary.LittleEndian.PutUint32(data[4:], permitted[0])
+	binary.LittleEndian.PutUint32(data[12:], permitted[1])
+	// the inheritable capabilities at 8 and 16 stay empty
+
+	return string(data), nil
+}
@@ -0,0 +1,216 @@
+package dkrpackage
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestFilesHardLinks(t *testing.T) {
+	capability, err := capabilityXattr([]string{"cap_net_bind_service"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, linkedPath := range []string{"/bin/hello", "/bin/hard"} {
+		conf := &Config{Files: []FileConfig{{
+			Paths:        []string{linkedPath},
+			Mode:         "4755",
+			Owner:        "1:2",
+			Capabilities: []string{"cap_net_bind_service"},
+		}}}
+
+		hdrs, err := packageHeaders(t, conf, bytes.NewReader(mkTar(t,
+			testEntry{name: "bin/", mode: 0755},
+			testEntry{name: "bin/hello", body: "hello", mode: 0755},
+			testEntry{name: "bin/hard", linkname: "bin/hello"},
+		)))
+		if err != nil {
+			t.Fatalf("%s: %s", linkedPath, err)
+		}
+
+		data, link := hdrs["bin/hello"], hdrs["bin/hard"]
+		if data.Typeflag != tar.TypeReg || link.Typeflag != tar.TypeLink {
+			t.Fatalf("%s: expected bin/hard to link to bin/hello", linkedPath)
+		}
+		for _, hdr := range []*tar.Header{data, link} {
+			if hdr.Mode&07777 != 04755 || hdr.Uid != 1 || hdr.Gid != 2 {
+				t.Fatalf("%s: expected %s to be 4755 1:2, got %o %d:%d", linkedPath, hdr.Name, hdr.Mode, hdr.Uid, hdr.Gid)
+			}
+		}
+		if data.PAXRecords[xattrCapability] != capability {
+			t.Fatalf("%s: expected the capabilities on the data entry", linkedPath)
+		}
+	}
+}
+
+func TestCapabilityXattr(t *testing.T) {
+	tests := []struct {
+		names     []string
+		permitted [2]uint32
+		err       string
+	}{
+		{names: []string{"cap_net_bind_service"}, permitted: [2]uint32{1 << 10, 0}},
+		{names: []string{"CAP_CHOWN", "net_raw"}, permitted: [2]uint32{1<<0 | 1<<13, 0}},
+		{names: []string{"cap_bpf", "cap_setfcap"}, permitted: [2]uint32{1 << 31, 1 << 7}},
+		{names: []string{"cap_fly"}, err: `unknown capability "cap_fly"`},
+	}
+
+	for _, test := range tests {
+		xattr, err := capabilityXattr(test.names)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%v: expected error %q, got %v", test.names, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %s", test.names, err)
+			continue
+		}
+
+		expected := make([]byte, 20)
+		binary.LittleEndian.PutUint32(expected[0:], 0x02000001)
+		binary.LittleEndian.PutUint32(expected[4:], test.permitted[0])
+		binary.LittleEndian.PutUint32(expected[12:], test.permitted[1])
+		if xattr != string(expected) {
+			t.Errorf("%v: expected % x, got % x", test.names, expected, xattr)
+		}
+	}
+}
+
+func TestFiles(t *testing.T) {
+	input := func() *bytes.Reader {
+		return bytes.NewReader(mkTar(t,
+			testEntry{name: "etc/", mode: 0755},
+			testEntry{name: "etc/passwd", body: testPasswd},
+			testEntry{name: "etc/group", body: testGroup},
+			testEntry{name: "bin/", mode: 0755},
+			testEntry{name: "bin/app", body: "app", mode: 0755},
+			testEntry{name: "bin/sh", target: "app"},
+		))
+	}
+	capability, err := capabilityXattr([]string{"cap_net_bind_service"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		mode       int64
+		uid, gid   int
+		capability string
+	}
+
+	tests := []struct {
+		name     string
+		files    []FileConfig
+		expected map[string]result
+		err      string
+	}{
+		{
+			name:     "defaults",
+			expected: map[string]result{"bin/app": {mode: 0755}, "bin/sh": {mode: 0644}},
+		},
+		{
+			name: "mode, owner and capabilities",
+			files: []FileConfig{{
+				Paths:        []string{"/bin/app"},
+				Mode:         "4750",
+				Owner:        "app:staff",
+				Capabilities: []string{"cap_net_bind_service"},
+			}},
+			expected: map[string]result{"bin/app": {mode: 04750, uid: 1000, gid: 50, capability: capability}},
+		},
+		{
+			name:     "symlink mode",
+			files:    []FileConfig{{Paths: []string{"/bin/*"}, Mode: "700", Owner: "1000"}},
+			expected: map[string]result{"bin/app": {mode: 0700, uid: 1000, gid: 1000}, "bin/sh": {mode: 0644, uid: 1000, gid: 1000}},
+		},
+		{
+			name: "later rules override",
+			files: []FileConfig{
+				{Paths: []string{"/bin/**"}, Mode: "755", Owner: "app"},
+				{Paths: []string{"/bin/app"}, Mode: "2755"},
+			},
+			expected: map[string]result{"bin/": {mode: 0755, uid: 1000, gid: 1001}, "bin/app": {mode: 02755, uid: 1000, gid: 1001}},
+		},
+		{
+			name:  "capabilities on a directory",
+			files: []FileConfig{{Paths: []string{"/bin"}, Capabilities: []string{"cap_net_raw"}}},
+			err:   "capabilities can only be set on regular files: /bin/",
+		},
+		{
+			name:  "capabilities on a symlink",
+			files: []FileConfig{{Paths: []string{"/bin/sh"}, Capabilities: []string{"cap_net_raw"}}},
+			err:   "capabilities can only be set on regular files: /bin/sh",
+		},
+		{
+			name:  "no paths",
+			files: []FileConfig{{Mode: "755"}},
+			err:   "file config without paths",
+		},
+		{
+			name:  "invalid pattern",
+			files: []FileConfig{{Paths: []string{"/bin/["}}},
+			err:   `invalid path pattern "/bin/["`,
+		},
+		{
+			name:  "non-octal mode",
+			files: []FileConfig{{Paths: []string{"/bin/app"}, Mode: "9"}},
+			err:   `invalid mode "9" for /bin/app`,
+		},
+		{
+			name:  "symbolic mode",
+			files: []FileConfig{{Paths: []string{"/bin/app"}, Mode: "rwx"}},
+			err:   `invalid mode "rwx" for /bin/app`,
+		},
+		{
+			name:  "mode out of range",
+			files: []FileConfig{{Paths: []string{"/bin/app"}, Mode: "17777"}},
+			err:   `invalid mode "17777" for /bin/app`,
+		},
+		{
+			name:  "preserve owner",
+			files: []FileConfig{{Paths: []string{"/bin/app"}, Owner: "preserve"}},
+			err:   `invalid owner "preserve" for /bin/app (only valid in ownership)`,
+		},
+		{
+			name:  "unknown owner",
+			files: []FileConfig{{Paths: []string{"/bin/app"}, Owner: "nobody"}},
+			err:   `unknown user "nobody"`,
+		},
+		{
+			name:  "unknown capability",
+			files: []FileConfig{{Paths: []string{"/bin/app"}, Capabilities: []string{"cap_fly"}}},
+			err:   `unknown capability "cap_fly"`,
+		},
+	}
+
+	for _, test := range tests {
+		hdrs, err := packageHeaders(t, &Config{Files: test.files}, input())
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		for name, expected := range test.expected {
+			hdr := hdrs[name]
+			if hdr == nil {
+				t.Errorf("%s: missing %s", test.name, name)
+				continue
+			}
+			actual := result{mode: hdr.Mode & 07777, uid: hdr.Uid, gid: hdr.Gid, capability: hdr.PAXRecords[xattrCapability]}
+			if actual != expected {
+				t.Errorf("%s: expected %s to be %+v, got %+v", test.name, name, expected, actual)
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package dkrpackage
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"path"
+	"strings"
+
+	"github.com/docker/docker/pkg/fileutils"
+)
+
+// ignoreFile lists patterns of files to leave out of the layers of an
+// input, like a .dockerignore file.
+const ignoreFile = ".dkrignore"
+
+// excludes matches the entries to leave out of the layers. Patterns use the
+// syntax of .dockerignore files: a pattern matches a path or one of its
+// parent directories, `**` matches any number of directories and patterns
+// starting with `!` include the paths they match again. Later patterns
+// override earlier ones.
+type excludes struct {
+	patterns []string
+	dirs     [][]string
+}
+
+// newExcludes cleans up the patterns. Leading slashes are ignored, paths
+// are always relative to the root of the input.
+func newExcludes(patterns []string) (*excludes, error) {
+	var cleaned []string
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+
+		var negate string
+		if strings.HasPrefix(pattern, "!") {
+			negate, pattern = "!", strings.TrimSpace(pattern[1:])
+		}
+		pattern = strings.TrimPrefix(path.Clean("/"+pattern), "/")
+		if pattern == "" {
+			if negate != "" {
+				return nil, errors.New("invalid exclude pattern: !")
+			}
+			continue
+		}
+
+		cleaned = append(cleaned, negate+pattern)
+	}
+
+	patterns, dirs, _, err := fileutils.CleanPatterns(cleaned)
+	if err != nil {
+		return nil, err
+	}
+
+	// catch invalid patterns before the first file is matched
+	for _, pattern := range patterns {
+		_, err = fileutils.Matches("x", []string{pattern})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &excludes{patterns: patterns, dirs: dirs}, nil
+}
+
+// match reports whether an entry is excluded.
+func (e *excludes) match(name string) bool {
+	if len(e.patterns) == 0 {
+		return false
+	}
+
+	// patterns were checked by newExcludes
+	ok, _ := fileutils.OptimizedMatches(strings.TrimSuffix(name, "/"), e.patterns, e.dirs)
+	return ok
+}
+
+// filter returns the names that aren't excluded.
+func (e *excludes) filter(names []string) []string {
+	var kept []string
+	for _, name := range names {
+		if !e.match(name) {
+			kept = append(kept, name)
+		}
+	}
+	return kept
+}
+
+// parseIgnoreFile returns the patterns of an ignore file. Blank lines and
+// comments starting with # are skipped.
+func parseIgnoreFile(data []byte) []string {
+	var patterns []string
+
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+
+	return patterns
+}
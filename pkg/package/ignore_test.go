@@ -0,0 +1,111 @@
+package dkrpackage
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestExcludes(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		included []string
+		excluded []string
+	}{
+		{
+			patterns: nil,
+			included: []string{"a", "a/b/"},
+		},
+		{
+			patterns: []string{"/tmp", "*.log"},
+			included: []string{"var/tmp", "var/app.log", "tmp.d"},
+			excluded: []string{"tmp/", "tmp/a/b", "app.log"},
+		},
+		{
+			patterns: []string{"**/*.log"},
+			included: []string{"app.logs"},
+			excluded: []string{"app.log", "var/log/app.log"},
+		},
+		{
+			patterns: []string{"cache", "!cache/keep"},
+			included: []string{"cache/keep", "cache/keep/a"},
+			excluded: []string{"cache/", "cache/other", "cache/other/keep"},
+		},
+		{
+			patterns: []string{"docs", "!docs/*.md", "docs/secret.md"},
+			included: []string{"docs/README.md"},
+			excluded: []string{"docs/", "docs/a.txt", "docs/secret.md"},
+		},
+		{
+			patterns: []string{"/build/", "", "  ! /src/../build/keep "},
+			included: []string{"build/keep"},
+			excluded: []string{"build/", "build/other"},
+		},
+	}
+
+	for _, test := range tests {
+		e, err := newExcludes(test.patterns)
+		if err != nil {
+			t.Errorf("%q: %s", test.patterns, err)
+			continue
+		}
+		for _, name := range test.included {
+			if e.match(name) {
+				t.Errorf("%q: expected %s to be included", test.patterns, name)
+			}
+		}
+		for _, name := range test.excluded {
+			if !e.match(name) {
+				t.Errorf("%q: expected %s to be excluded", test.patterns, name)
+			}
+		}
+	}
+}
+
+func TestExcludesInvalid(t *testing.T) {
+	for _, patterns := range [][]string{{"!"}, {"! /"}, {"a/["}} {
+		_, err := newExcludes(patterns)
+		if err == nil {
+			t.Errorf("%q: expected an error", patterns)
+		}
+	}
+}
+
+func TestParseIgnoreFile(t *testing.T) {
+	patterns := parseIgnoreFile([]byte("# build output\nbuild\n\n  *.log  \n!keep.log\n\t# indented comment\n"))
+
+	expected := []string{"build", "*.log", "!keep.log"}
+	if !reflect.DeepEqual(patterns, expected) {
+		t.Errorf("expected %q, got %q", expected, patterns)
+	}
+}
+
+func TestIgnoreFile(t *testing.T) {
+	input := mkTar(t,
+		testEntry{name: ignoreFile, body: "cache\n!cache/keep\n*.log\n"},
+		testEntry{name: "app", body: "app"},
+		testEntry{name: "app.log", body: "log"},
+		testEntry{name: "keep.log", body: "log"},
+		testEntry{name: "cache/", mode: 0755},
+		testEntry{name: "cache/keep", body: "keep"},
+		testEntry{name: "cache/tmp/", mode: 0755},
+		testEntry{name: "cache/tmp/a", body: "a"},
+	)
+
+	hdrs, err := packageHeaders(t, &Config{Exclude: []string{"!keep.log", "app"}}, bytes.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for name := range hdrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	expected := []string{"cache/keep", "keep.log"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %q, got %q", expected, names)
+	}
+}
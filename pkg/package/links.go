@@ -0,0 +1,39 @@
+package dkrpackage
+
+// linkGroups records the hard links of an input. A hard link entry refers
+// to an earlier entry that holds the data; all paths of a group share its
+// inode and so its mode, owner and xattrs.
+type linkGroups struct {
+	data  map[string]string   // path -> path of the entry with the data
+	paths map[string][]string // path of the entry with the data -> all paths
+}
+
+// add records a hard link from name to linkname. Links to links are
+// resolved to the entry with the data.
+func (g *linkGroups) add(name, linkname string) {
+	if g.data == nil {
+		g.data = map[string]string{}
+		g.paths = map[string][]string{}
+	}
+
+	if d, ok := g.data[linkname]; ok {
+		linkname = d
+	}
+	if _, ok := g.paths[linkname]; !ok {
+		g.data[linkname] = linkname
+		g.paths[linkname] = []string{linkname}
+	}
+
+	g.data[name] = linkname
+	g.paths[linkname] = append(g.paths[linkname], name)
+}
+
+// group returns the paths that share their data with name, starting with
+// the entry that holds it. Paths without hard links are alone in their
+// group.
+func (g *linkGroups) group(name string) []string {
+	if d, ok := g.data[name]; ok {
+		return g.paths[d]
+	}
+	return []string{name}
+}
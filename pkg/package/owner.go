@@ -0,0 +1,258 @@
+package dkrpackage
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// OwnershipConfig sets the owner of the files in the new layers.
+//
+// Owners are written as UID:GID or USER:GROUP. Names are resolved against
+// /etc/passwd and /etc/group of the image. A lone UID also sets the group
+// to UID, a lone USER sets the group to the primary group of the user.
+type OwnershipConfig struct {
+	// Owner of all files. "preserve" keeps the ownership found in the
+	// input. Defaults to 0:0.
+	Owner string `json:"owner"`
+
+	// Rules override the owner of the files matching their paths; the first
+	// matching rule wins.
+	Rules []OwnerRule `json:"rules"`
+}
+
+// OwnerRule sets the owner of the files matching one of Paths. Paths are
+// globs where `**` matches any number of directories, so `/data/**` matches
+// /data and everything inside it.
+type OwnerRule struct {
+	Paths []string `json:"paths"`
+	Owner string   `json:"owner"`
+}
+
+const preserveOwner = "preserve"
+
+// owner is a resolved owner. A nil owner preserves the input's ownership.
+type owner struct {
+	uid, gid     int
+	uname, gname string
+}
+
+type ownerRule struct {
+	paths []string
+	owner *owner
+}
+
+// ownerPolicy assigns owners to tar headers.
+type ownerPolicy struct {
+	owner *owner
+	rules []ownerRule
+}
+
+// userDB holds the users and groups of an image.
+type userDB struct {
+	users  []dbEntry
+	groups []dbEntry
+}
+
+type dbEntry struct {
+	name string
+	id   int
+	gid  int
+}
+
+// newOwnerPolicy resolves an ownership config against the users and groups
+// of the image.
+func newOwnerPolicy(conf *OwnershipConfig, db *userDB) (*ownerPolicy, error) {
+	if conf == nil {
+		conf = &OwnershipConfig{}
+	}
+
+	policy := &ownerPolicy{}
+
+	var err error
+	policy.owner, err = db.resolve(conf.Owner)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rule := range conf.Rules {
+		for _, pattern := range rule.Paths {
+			if !validGlob(pattern) {
+				return nil, fmt.Errorf("invalid path pattern %q", pattern)
+			}
+		}
+
+		o, err := db.resolve(rule.Owner)
+		if err != nil {
+			return nil, err
+		}
+		policy.rules = append(policy.rules, ownerRule{paths: rule.Paths, owner: o})
+	}
+
+	return policy, nil
+}
+
+// apply sets the owner of a header. names are the paths that share the
+// entry's data through hard links; the first rule matching one of them
+// wins.
+func (p *ownerPolicy) apply(hdr *tar.Header, names []string) {
+	o := p.owner
+	for _, rule := range p.rules {
+		if matchesAnyName(names, rule.paths) {
+			o = rule.owner
+			break
+		}
+	}
+
+	if o == nil {
+		return
+	}
+	hdr.Uid = o.uid
+	hdr.Gid = o.gid
+	hdr.Uname = o.uname
+	hdr.Gname = o.gname
+}
+
+// resolve parses an owner. It returns nil for "preserve".
+func (db *userDB) resolve(spec string) (*owner, error) {
+	if spec == preserveOwner {
+		return nil, nil
+	}
+	if spec == "" {
+		spec = "0:0"
+	}
+
+	user, group := spec, ""
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		user, group = spec[:i], spec[i+1:]
+		if group == "" {
+			return nil, fmt.Errorf("invalid owner %q", spec)
+		}
+	}
+	if user == "" {
+		return nil, fmt.Errorf("invalid owner %q", spec)
+	}
+
+	o := &owner{}
+
+	if id, err := strconv.Atoi(user); err == nil {
+		o.uid, o.gid = id, id
+		if u, ok := db.userByID(id); ok {
+			o.uname = u.name
+		}
+	} else {
+		u, ok := db.userByName(user)
+		if !ok {
+			return nil, fmt.Errorf("unknown user %q in owner %q (not in /etc/passwd of the image)", user, spec)
+		}
+		o.uid, o.gid, o.uname = u.id, u.gid, u.name
+	}
+
+	if group != "" {
+		if id, err := strconv.Atoi(group); err == nil {
+			o.gid = id
+		} else {
+			g, ok := db.groupByName(group)
+			if !ok {
+				return nil, fmt.Errorf("unknown group %q in owner %q (not in /etc/group of the image)", group, spec)
+			}
+			o.gid = g.id
+		}
+	}
+	if g, ok := db.groupByID(o.gid); ok {
+		o.gname = g.name
+	}
+
+	if o.uid < 0 || o.gid < 0 {
+		return nil, fmt.Errorf("invalid owner %q", spec)
+	}
+
+	return o, nil
+}
+
+func (db *userDB) userByName(name string) (dbEntry, bool) {
+	for _, e := range db.users {
+		if e.name == name {
+			return e, true
+		}
+	}
+	return dbEntry{}, false
+}
+
+func (db *userDB) userByID(id int) (dbEntry, bool) {
+	for _, e := range db.users {
+		if e.id == id {
+			return e, true
+		}
+	}
+	return dbEntry{}, false
+}
+
+func (db *userDB) groupByName(name string) (dbEntry, bool) {
+	for _, e := range db.groups {
+		if e.name == name {
+			return e, true
+		}
+	}
+	return dbEntry{}, false
+}
+
+func (db *userDB) groupByID(id int) (dbEntry, bool) {
+	for _, e := range db.groups {
+		if e.id == id {
+			return e, true
+		}
+	}
+	return dbEntry{}, false
+}
+
+// newUserDB parses the contents of /etc/passwd and /etc/group. Malformed
+// lines are skipped.
+func newUserDB(passwd, group []byte) *userDB {
+	db := &userDB{}
+
+	// name:password:uid:gid:gecos:home:shell
+	for _, fields := range dbLines(passwd) {
+		if len(fields) < 4 {
+			continue
+		}
+		uid, err1 := strconv.Atoi(fields[2])
+		gid, err2 := strconv.Atoi(fields[3])
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		db.users = append(db.users, dbEntry{name: fields[0], id: uid, gid: gid})
+	}
+
+	// name:password:gid:members
+	for _, fields := range dbLines(group) {
+		if len(fields) < 3 {
+			continue
+		}
+		gid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+		db.groups = append(db.groups, dbEntry{name: fields[0], id: gid, gid: gid})
+	}
+
+	return db
+}
+
+func dbLines(data []byte) [][]string {
+	var lines [][]string
+
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, strings.Split(line, ":"))
+	}
+
+	return lines
+}
@@ -0,0 +1,170 @@
+package dkrpackage
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	testPasswd = `# users
+root:x:0:0:root:/root:/bin/sh
+app:x:1000:1001::/home/app:/bin/sh
+broken:x:nope:1
+`
+	testGroup = `root:x:0:
+staff:x:50:app
+app:x:1001:
+`
+)
+
+func TestResolveOwner(t *testing.T) {
+	db := newUserDB([]byte(testPasswd), []byte(testGroup))
+
+	tests := []struct {
+		spec  string
+		owner *owner
+		err   string
+	}{
+		{spec: "", owner: &owner{uid: 0, gid: 0, uname: "root", gname: "root"}},
+		{spec: "0:0", owner: &owner{uid: 0, gid: 0, uname: "root", gname: "root"}},
+		{spec: "preserve", owner: nil},
+		{spec: "app", owner: &owner{uid: 1000, gid: 1001, uname: "app", gname: "app"}},
+		{spec: "app:staff", owner: &owner{uid: 1000, gid: 50, uname: "app", gname: "staff"}},
+		{spec: "1000", owner: &owner{uid: 1000, gid: 1000, uname: "app"}},
+		{spec: "1000:50", owner: &owner{uid: 1000, gid: 50, uname: "app", gname: "staff"}},
+		{spec: "2000:3000", owner: &owner{uid: 2000, gid: 3000}},
+		{spec: "broken", err: `unknown user "broken"`},
+		{spec: "nobody", err: `unknown user "nobody"`},
+		{spec: "app:wheel", err: `unknown group "wheel"`},
+		{spec: ":50", err: `invalid owner ":50"`},
+		{spec: "app:", err: `invalid owner "app:"`},
+		{spec: "-1:0", err: `invalid owner "-1:0"`},
+	}
+
+	for _, test := range tests {
+		o, err := db.resolve(test.spec)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: expected error %q, got %v", test.spec, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", test.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(o, test.owner) {
+			t.Errorf("%q: expected %+v, got %+v", test.spec, test.owner, o)
+		}
+	}
+}
+
+func TestMatchesAnyGlob(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		match   bool
+	}{
+		{"data", "/data/**", true},
+		{"data/", "/data/**", true},
+		{"data/a/b", "/data/**", true},
+		{"database", "/data/**", false},
+		{"bin/sh", "/bin/*", true},
+		{"bin/x/sh", "/bin/*", false},
+		{"usr/local/bin/app", "/usr/**/app", true},
+		{"usr/app", "/usr/**/app", true},
+		{"etc/app.conf", "etc/*.conf", true},
+	}
+
+	for _, test := range tests {
+		if match := matchesAnyGlob(test.name, []string{test.pattern}); match != test.match {
+			t.Errorf("%s %s: expected %v, got %v", test.pattern, test.name, test.match, match)
+		}
+	}
+}
+
+func TestOwnership(t *testing.T) {
+	input := func() *bytes.Reader {
+		return bytes.NewReader(mkTar(t,
+			testEntry{name: "etc/", mode: 0755},
+			testEntry{name: "etc/passwd", body: testPasswd},
+			testEntry{name: "etc/group", body: testGroup},
+			testEntry{name: "data/", mode: 0755, uid: 7, gid: 7},
+			testEntry{name: "data/file", body: "x", uid: 7, gid: 8},
+			testEntry{name: "bin/", mode: 0755, uid: 7, gid: 7},
+			testEntry{name: "bin/app", body: "x", uid: 7, gid: 8},
+		))
+	}
+
+	type ids struct{ uid, gid int }
+
+	tests := []struct {
+		name      string
+		ownership *OwnershipConfig
+		expected  map[string]ids
+		err       string
+	}{
+		{
+			name:     "default",
+			expected: map[string]ids{"data/file": {0, 0}, "bin/app": {0, 0}},
+		},
+		{
+			name:      "explicit root",
+			ownership: &OwnershipConfig{Owner: "0:0"},
+			expected:  map[string]ids{"data/file": {0, 0}, "bin/app": {0, 0}},
+		},
+		{
+			name:      "preserve",
+			ownership: &OwnershipConfig{Owner: "preserve"},
+			expected:  map[string]ids{"data/": {7, 7}, "data/file": {7, 8}, "bin/app": {7, 8}},
+		},
+		{
+			name: "rules with names from the input",
+			ownership: &OwnershipConfig{
+				Owner: "preserve",
+				Rules: []OwnerRule{
+					{Paths: []string{"/data/**"}, Owner: "app"},
+					{Paths: []string{"/data/file", "/bin/*"}, Owner: "app:staff"},
+				},
+			},
+			expected: map[string]ids{"data/": {1000, 1001}, "data/file": {1000, 1001}, "bin/": {7, 7}, "bin/app": {1000, 50}},
+		},
+		{
+			name:      "unknown user",
+			ownership: &OwnershipConfig{Rules: []OwnerRule{{Paths: []string{"/data"}, Owner: "nobody"}}},
+			err:       `unknown user "nobody"`,
+		},
+		{
+			name:      "invalid pattern",
+			ownership: &OwnershipConfig{Rules: []OwnerRule{{Paths: []string{"/data/["}, Owner: "app"}}},
+			err:       `invalid path pattern "/data/["`,
+		},
+	}
+
+	for _, test := range tests {
+		hdrs, err := packageHeaders(t, &Config{Ownership: test.ownership}, input())
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		for name, expected := range test.expected {
+			hdr := hdrs[name]
+			if hdr == nil {
+				t.Errorf("%s: missing %s", test.name, name)
+				continue
+			}
+			if hdr.Uid != expected.uid || hdr.Gid != expected.gid {
+				t.Errorf("%s: expected %s to be owned by %d:%d, got %d:%d", test.name, name, expected.uid, expected.gid, hdr.Uid, hdr.Gid)
+			}
+		}
+	}
+}
@@ -2,44 +2,155 @@ package dkrpackage
 
 import (
 	"archive/tar"
-	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 	"path"
 	"strings"
 	"time"
+
+	"github.com/fd/dkr-util/pkg/archive"
+	"github.com/fd/dkr-util/pkg/registry"
 )
 
-func Package(dst io.Writer, src io.Reader) error {
-	layerTar, conf, err := mkLayerTar(src)
-	if err != nil {
-		return err
+// Options control how images are packaged.
+type Options struct {
+	// Format of the output archive. Defaults to dkrarchive.FormatDocker.
+	Format string
+
+	// Base is an image archive to build on top of. The new layers are added
+	// on top of its layers and .docker.json overrides its config.
+	Base io.Reader
+
+	// Platforms turns the image into a multi-platform image with one image
+	// per platform. The sources are shared by all platforms, each platform
+	// input is added on top of them.
+	Platforms []PlatformInput
+
+	// Verbose reports the files that are left out of the layers.
+	Verbose bool
+}
+
+// PlatformInput is the rootfs tar stream of one platform of a
+// multi-platform image.
+type PlatformInput struct {
+	Platform *dkrarchive.Platform
+	Src      io.Reader
+}
+
+// Package builds an image from one or more rootfs tar streams. Each source
+// becomes its own layer, stacked in the order given. The .docker.json of
+// the last source that has one configures the image. Sources and layers
+// are spooled to temporary files while packaging.
+func Package(dst io.Writer, srcs []io.Reader, opts Options) error {
+	if len(srcs) == 0 && len(opts.Platforms) == 0 {
+		return errors.New("no inputs to package")
 	}
 
-	imageConf, err := mkImageConfig(conf)
+	spool, err := dkrarchive.NewSpool()
 	if err != nil {
 		return err
 	}
+	defer spool.Close()
+
+	var inputs []*input
+	for _, src := range srcs {
+		in, err := spoolInput(spool, src)
+		if err != nil {
+			return err
+		}
+		inputs = append(inputs, in)
+	}
+
+	if len(opts.Platforms) > 0 {
+		return packageIndex(dst, spool, inputs, opts)
+	}
+
+	conf := &Config{}
+	if opts.Base != nil {
+		conf, err = loadBase(spool, opts.Base)
+		if err != nil {
+			return err
+		}
+	}
 
-	manifest, err := mkManifest(conf)
+	img, err := mkImage(spool, inputs, conf, nil, opts.Verbose)
 	if err != nil {
 		return err
 	}
 
-	out, err := mkImageArchive(conf, manifest, imageConf, layerTar)
+	return dkrarchive.Write(dst, opts.Format, spool, img)
+}
+
+// packageIndex builds an image for every platform and writes them as an
+// image index. All platforms must use the same repo tags.
+func packageIndex(dst io.Writer, spool *dkrarchive.Spool, inputs []*input, opts Options) error {
+	if opts.Base != nil {
+		return errors.New("a base image can't be combined with platforms")
+	}
+	if opts.Format != "" && opts.Format != dkrarchive.FormatOCI {
+		return fmt.Errorf("multi-platform images require the %s format", dkrarchive.FormatOCI)
+	}
+
+	idx := &dkrarchive.ImageIndex{}
+	for i, p := range opts.Platforms {
+		in, err := spoolInput(spool, p.Src)
+		if err != nil {
+			return err
+		}
+
+		platformInputs := append(inputs[:len(inputs):len(inputs)], in)
+		img, err := mkImage(spool, platformInputs, &Config{}, p.Platform, opts.Verbose)
+		if err != nil {
+			return err
+		}
+
+		if i == 0 {
+			idx.RepoTags = img.RepoTags
+		} else if strings.Join(img.RepoTags, " ") != strings.Join(idx.RepoTags, " ") {
+			return fmt.Errorf("platform %s has different repo tags", p.Platform)
+		}
+
+		img.RepoTags = nil
+		idx.Images = append(idx.Images, img)
+	}
+
+	return dkrarchive.WriteIndexes(dst, spool, idx)
+}
+
+// mkImage builds an image from spooled inputs on top of conf. When platform
+// is set it overrides the platform of the config.
+func mkImage(spool *dkrarchive.Spool, inputs []*input, conf *Config, platform *dkrarchive.Platform, verbose bool) (*dkrarchive.Image, error) {
+	conf, err := mkLayers(spool, inputs, conf, verbose)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if platform != nil {
+		conf.OS = platform.OS
+		conf.Architecture = platform.Architecture
+		conf.Variant = platform.Variant
 	}
 
-	_, err = io.Copy(dst, bytes.NewReader(out))
+	imageConf, err := mkImageConfig(conf)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	img := &dkrarchive.Image{Config: imageConf, Platform: platform}
+	for _, tag := range conf.RepoTags {
+		img.RepoTags = append(img.RepoTags, dkrregistry.ParseRef(tag).String())
+	}
+	for _, l := range conf.layers {
+		img.Layers = append(img.Layers, l.Layer)
+	}
+
+	return img, nil
 }
 
 type Config struct {
@@ -47,11 +158,28 @@ type Config struct {
 	Author       string           `json:"author"`
 	Architecture string           `json:"architecture"`
 	OS           string           `json:"os"`
+	Variant      string           `json:"variant"`
 	Config       *ContainerConfig `json:"config"`
+	Layers       []LayerConfig    `json:"layers"`
+	Ownership    *OwnershipConfig `json:"ownership"`
+	Files        []FileConfig     `json:"files"`
+	Exclude      []string         `json:"exclude"`
 
-	diffID    string
-	imageID   string
+	layers    []*layer
+	history   []historyEntry
 	imageTime time.Time
+
+	// passwd and group are the user databases of the base image.
+	passwd []byte
+	group  []byte
+}
+
+// LayerConfig splits the files of an input into a separate layer. Files are
+// put in the first layer with a matching path prefix; all remaining files go
+// into a final layer on top.
+type LayerConfig struct {
+	Paths   []string `json:"paths"`
+	Comment string   `json:"comment"`
 }
 
 type ContainerConfig struct {
@@ -65,6 +193,52 @@ type ContainerConfig struct {
 	Cmd          []string
 	Volumes      map[string]struct{}
 	WorkingDir   string
+	Labels       map[string]string `json:",omitempty"`
+	Healthcheck  *HealthConfig     `json:",omitempty"`
+	StopSignal   string            `json:",omitempty"`
+	StopTimeout  *int              `json:",omitempty"`
+	Shell        []string          `json:",omitempty"`
+	OnBuild      []string          `json:",omitempty"`
+	ArgsEscaped  bool              `json:",omitempty"`
+}
+
+// HealthConfig is the health check of a container. Test is empty to
+// inherit the check of the base image, ["NONE"] to disable it, or
+// ["CMD", args...] or ["CMD-SHELL", command] to run a command.
+type HealthConfig struct {
+	Test        []string `json:",omitempty"`
+	Interval    Duration `json:",omitempty"`
+	Timeout     Duration `json:",omitempty"`
+	StartPeriod Duration `json:",omitempty"`
+	Retries     int      `json:",omitempty"`
+}
+
+// Duration is a time.Duration that is stored in nanoseconds, like in
+// image configs, but may also be written as a string like "30s".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(int64(d))
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		v, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		*d = Duration(v)
+		return nil
+	}
+
+	var ns int64
+	err := json.Unmarshal(data, &ns)
+	if err != nil {
+		return fmt.Errorf("invalid duration %s (expected nanoseconds or a string like \"30s\")", data)
+	}
+	*d = Duration(ns)
+	return nil
 }
 
 type imageConfig struct {
@@ -73,6 +247,7 @@ type imageConfig struct {
 	Author       string           `json:"author"`
 	Architecture string           `json:"architecture"`
 	OS           string           `json:"os"`
+	Variant      string           `json:"variant,omitempty"`
 	Config       *ContainerConfig `json:"config"`
 	RootFS       rootFSConfig     `json:"rootfs"`
 	History      []historyEntry   `json:"history"`
@@ -91,22 +266,241 @@ type historyEntry struct {
 	EmptyLayer bool      `json:"empty_layer,omitempty"`
 }
 
-type manifestEntry struct {
-	Config   string
-	RepoTags []string
-	Layers   []string
+type layer struct {
+	*dkrarchive.Layer
+	comment   string
+	inherited bool
+}
+
+type input struct {
+	content *dkrarchive.Content
+	conf    []byte
+	ignore  []byte
+	time    time.Time
+	passwd  []byte
+	group   []byte
+	links   linkGroups
+}
+
+// entryRules decide which entries of an input go into the layers and how
+// their headers are rewritten.
+type entryRules struct {
+	exclude *excludes
+	links   *linkGroups
+	owners  *ownerPolicy
+	files   *filePolicy
+	verbose bool
+}
+
+type layerWriter struct {
+	w       *dkrarchive.ContentWriter
+	tw      *tar.Writer
+	comment string
 }
 
 var ftime = time.Date(1988, time.February, 1, 0, 0, 0, 0, time.UTC)
 
-func mkLayerTar(src io.Reader) ([]byte, *Config, error) {
+func mkLayers(spool *dkrarchive.Spool, inputs []*input, conf *Config, verbose bool) (*Config, error) {
+	var (
+		confData  []byte
+		confInput = -1
+		imageTime = ftime
+	)
+
+	if conf.imageTime.After(imageTime) {
+		imageTime = conf.imageTime
+	}
+
+	for i, in := range inputs {
+		if in.time.After(imageTime) {
+			imageTime = in.time
+		}
+
+		if len(in.conf) > 0 {
+			confData = in.conf
+			confInput = i
+		}
+	}
+
+	// .docker.json is decoded on top of the base config so that only the
+	// fields it sets override the inherited ones.
+	if len(confData) > 0 {
+		err := decodeConfig(confData, conf)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// owner names are resolved against the user databases of the image
+	passwd, group := conf.passwd, conf.group
+	for _, in := range inputs {
+		if in.passwd != nil {
+			passwd = in.passwd
+		}
+		if in.group != nil {
+			group = in.group
+		}
+	}
+
+	var (
+		db    = newUserDB(passwd, group)
+		rules = entryRules{verbose: verbose}
+		err   error
+	)
+	rules.owners, err = newOwnerPolicy(conf.Ownership, db)
+	if err != nil {
+		return nil, err
+	}
+	rules.files, err = newFilePolicy(conf.Files, db)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, in := range inputs {
+		var layerConfs []LayerConfig
+		if i == confInput {
+			layerConfs = conf.Layers
+		}
+
+		// the exclude list of .docker.json comes after the patterns of the
+		// input's .dkrignore so it can include files again
+		rules.exclude, err = newExcludes(append(parseIgnoreFile(in.ignore), conf.Exclude...))
+		if err != nil {
+			return nil, err
+		}
+		rules.links = &in.links
+
+		layers, err := writeLayers(spool, in.content, layerConfs, rules)
+		if err != nil {
+			return nil, err
+		}
+		conf.layers = append(conf.layers, layers...)
+	}
+
+	conf.imageTime = imageTime
+
+	return conf, nil
+}
+
+func loadBase(spool *dkrarchive.Spool, src io.Reader) (*Config, error) {
+	a, err := dkrarchive.Read(src, spool)
+	if err != nil {
+		return nil, err
+	}
+
+	images, err := a.ReadImages(spool)
+	if err != nil {
+		return nil, err
+	}
+	if len(images) != 1 {
+		return nil, fmt.Errorf("base archive must contain exactly one image (found %d)", len(images))
+	}
+
+	var iconf imageConfig
+	err = json.Unmarshal(images[0].Config, &iconf)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &Config{
+		Author:       iconf.Author,
+		Architecture: iconf.Architecture,
+		OS:           iconf.OS,
+		Variant:      iconf.Variant,
+		Config:       iconf.Config,
+		history:      iconf.History,
+		imageTime:    iconf.Created,
+	}
+
+	for _, l := range images[0].Layers {
+		conf.layers = append(conf.layers, &layer{Layer: l, inherited: true})
+
+		err = readUserFiles(l.Tar, &conf.passwd, &conf.group)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return conf, nil
+}
+
+// matchesAnyGlob reports whether name matches one of the patterns. Patterns
+// are matched per path element like path.Match, except that `**` matches
+// any number of elements.
+func matchesAnyGlob(name string, patterns []string) bool {
+	elems := strings.Split(strings.TrimSuffix(name, "/"), "/")
+	for _, pattern := range patterns {
+		if matchGlob(globElems(pattern), elems) {
+			return true
+		}
+	}
+	return false
+}
+
+func validGlob(pattern string) bool {
+	for _, elem := range globElems(pattern) {
+		if _, err := path.Match(elem, ""); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func globElems(pattern string) []string {
+	pattern = strings.TrimPrefix(path.Join("/", pattern), "/")
+	if pattern == "" {
+		return nil
+	}
+	return strings.Split(pattern, "/")
+}
+
+func matchGlob(pattern, elems []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := len(elems); i >= 0; i-- {
+				if matchGlob(pattern[1:], elems[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(elems) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], elems[0]); !ok {
+			return false
+		}
+		pattern, elems = pattern[1:], elems[1:]
+	}
+	return len(elems) == 0
+}
+
+func matchesAnyPrefix(name string, prefixes []string) bool {
+	name = strings.TrimSuffix(name, "/")
+	for _, prefix := range prefixes {
+		prefix = strings.TrimPrefix(path.Join("/", prefix), "/")
+		if prefix == "" || name == prefix || strings.HasPrefix(name, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// spoolInput copies a rootfs tar stream into the spool. It also extracts
+// the contents of .docker.json, .dkrignore, /etc/passwd and /etc/group (if
+// any) and the latest timestamp found in the stream.
+func spoolInput(spool *dkrarchive.Spool, src io.Reader) (*input, error) {
+	w, err := spool.Create()
+	if err != nil {
+		return nil, err
+	}
+
 	var (
 		confData  []byte
-		tarBuf    bytes.Buffer
-		conf      *Config
 		imageTime = ftime
-		r         = tar.NewReader(src)
-		w         = tar.NewWriter(&tarBuf)
+		in        = &input{}
+		r         = tar.NewReader(io.TeeReader(src, w))
 	)
 
 	for {
@@ -115,36 +509,17 @@ func mkLayerTar(src io.Reader) ([]byte, *Config, error) {
 			break
 		}
 		if err != nil {
-			return nil, nil, err
+			w.Close()
+			return nil, err
 		}
 
 		atime := hdr.AccessTime
 		ctime := hdr.ChangeTime
 		mtime := hdr.ModTime
 
-		hdr.AccessTime = ftime
-		hdr.ChangeTime = ftime
-		hdr.ModTime = ftime
-		hdr.Name = strings.TrimPrefix(path.Join("/", hdr.Name), "/")
-		if hdr.FileInfo().IsDir() {
-			hdr.Name += "/"
-		}
-		if hdr.Linkname != "" {
-			hdr.Linkname = strings.TrimPrefix(path.Join("/", hdr.Linkname), "/")
-		}
-		if hdr.Name == "/" {
-			io.Copy(ioutil.Discard, r)
-			continue
-		}
-		if strings.HasPrefix(path.Base(hdr.Name), "._") {
-			io.Copy(ioutil.Discard, r)
+		if !normalizeHeader(hdr) {
 			continue
 		}
-		hdr.Gid = 1
-		hdr.Uid = 1
-		hdr.Gname = "root"
-		hdr.Uname = "root"
-		hdr.Xattrs = nil
 
 		if atime.After(imageTime) {
 			imageTime = atime
@@ -156,246 +531,341 @@ func mkLayerTar(src io.Reader) ([]byte, *Config, error) {
 			imageTime = mtime
 		}
 
-		if hdr.Name == ".docker.json" {
-			confData, err = ioutil.ReadAll(r)
-			if err != nil {
-				return nil, nil, err
-			}
-			continue
+		if hdr.Typeflag == tar.TypeLink {
+			in.links.add(hdr.Name, hdr.Linkname)
 		}
 
-		err = w.WriteHeader(hdr)
-		if err != nil {
-			return nil, nil, err
+		if hdr.Name == ".docker.json" {
+			confData, err = ioutil.ReadAll(r)
+		} else if hdr.Name == ignoreFile {
+			in.ignore, err = ioutil.ReadAll(r)
+		} else {
+			err = readUserFile(hdr, r, &in.passwd, &in.group)
 		}
-
-		_, err = io.Copy(w, r)
 		if err != nil {
-			return nil, nil, err
+			w.Close()
+			return nil, err
 		}
 	}
 
-	err := w.Close()
+	// keep whatever follows the end of the archive so the spooled copy is
+	// complete
+	_, err = io.Copy(w, src)
 	if err != nil {
-		return nil, nil, err
+		w.Close()
+		return nil, err
 	}
 
-	if len(confData) > 0 {
-		err := json.Unmarshal(confData, &conf)
-		if err != nil {
-			return nil, nil, err
-		}
+	in.content, err = w.Content()
+	if err != nil {
+		return nil, err
 	}
 
-	if conf == nil {
-		conf = &Config{}
+	in.conf = confData
+	in.time = imageTime
+	return in, nil
+}
+
+// readUserFiles reads /etc/passwd and /etc/group from a layer tar. They are
+// left alone when the layer doesn't contain them.
+func readUserFiles(layer *dkrarchive.Content, passwd, group *[]byte) error {
+	src, err := layer.Open()
+	if err != nil {
+		return err
 	}
+	defer src.Close()
 
-	layerSum := sha256.Sum256(tarBuf.Bytes())
-	diffID := hex.EncodeToString(layerSum[:])
-	conf.diffID = diffID
-	conf.imageTime = imageTime
+	r := tar.NewReader(src)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
 
-	return tarBuf.Bytes(), conf, nil
+		hdr.Name = strings.TrimPrefix(path.Join("/", hdr.Name), "/")
+		err = readUserFile(hdr, r, passwd, group)
+		if err != nil {
+			return err
+		}
+	}
 }
 
-func mkImageConfig(conf *Config) ([]byte, error) {
-	iconf := &imageConfig{
-		Created:      conf.imageTime,
-		Author:       conf.Author,
-		Architecture: conf.Architecture,
-		OS:           conf.OS,
-		Config:       conf.Config,
+// readUserFile reads the entry into passwd or group when it is /etc/passwd
+// or /etc/group. The header name must be normalized.
+func readUserFile(hdr *tar.Header, r io.Reader, passwd, group *[]byte) error {
+	if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+		return nil
+	}
 
-		RootFS: rootFSConfig{
-			Type:    "layers",
-			DiffIDs: []string{"sha256:" + conf.diffID},
-		},
+	var dst *[]byte
+	switch hdr.Name {
+	case "etc/passwd":
+		dst = passwd
+	case "etc/group":
+		dst = group
+	default:
+		return nil
+	}
 
-		History: []historyEntry{
-			{
-				Author:    conf.Author,
-				Created:   conf.imageTime,
-				CreatedBy: "/bin/sh -c #(nop) dkr-package",
-				Comment:   "Created by dkr-package",
-			},
-		},
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
 	}
+	*dst = data
+	return nil
+}
 
-	if iconf.OS == "" {
-		iconf.OS = "linux"
+// normalizeHeader strips the timestamps, extended attributes and format
+// details of a header, so the layers don't depend on the tar implementation
+// that wrote the input. It returns false for entries that must be left out
+// of the layers.
+func normalizeHeader(hdr *tar.Header) bool {
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+	hdr.ModTime = ftime
+	hdr.Format = tar.FormatUnknown
+	if hdr.Typeflag == tar.TypeRegA || hdr.Typeflag == tar.TypeGNUSparse {
+		// sparse files are read with their holes filled in
+		hdr.Typeflag = tar.TypeReg
 	}
-	if iconf.Architecture == "" {
-		iconf.Architecture = "amd64"
+	hdr.Name = strings.TrimPrefix(path.Join("/", hdr.Name), "/")
+	if hdr.FileInfo().IsDir() {
+		hdr.Name += "/"
+	}
+	if hdr.Typeflag == tar.TypeLink {
+		// hard links point to a path in the archive, symlink targets are
+		// kept as they are
+		hdr.Linkname = strings.TrimPrefix(path.Join("/", hdr.Linkname), "/")
 	}
+	if hdr.Name == "/" {
+		return false
+	}
+	if strings.HasPrefix(path.Base(hdr.Name), "._") {
+		return false
+	}
+	hdr.Xattrs = nil
+	hdr.PAXRecords = nil
 
-	imageIDSum := sha256.Sum256([]byte(conf.diffID + conf.imageTime.String()))
-	imageIDHex := hex.EncodeToString(imageIDSum[:])
-	iconf.ID = imageIDHex
+	return true
+}
 
-	data, err := json.Marshal(&iconf)
+// writeLayers writes a spooled input as layer tars. Files are put in the
+// layer of the first layer config with a matching path prefix and all
+// remaining files go into a final layer on top. Layers without files are
+// left out, except when there are no layer configs. Excluded files are
+// skipped, the owners of the others are set by the owner policy and then
+// the file configs are applied. Owner rules and file configs that match any
+// path of a hard link group apply to the entry with the data, and the hard
+// links get the same mode and owner. When the entry with the data is
+// excluded, the first remaining path of its group holds the data instead.
+func writeLayers(spool *dkrarchive.Spool, input *dkrarchive.Content, layerConfs []LayerConfig, rules entryRules) ([]*layer, error) {
+	src, err := input.Open()
 	if err != nil {
 		return nil, err
 	}
+	defer src.Close()
 
-	imageSum := sha256.Sum256(data)
-	imageHex := hex.EncodeToString(imageSum[:])
-	conf.imageID = imageHex
-
-	return data, nil
-}
-
-func mkManifest(conf *Config) ([]byte, error) {
-	manifest := []manifestEntry{
-		{
-			Config:   conf.imageID + ".json",
-			RepoTags: conf.RepoTags,
-			Layers:   []string{conf.diffID + "/layer.tar"},
-		},
-	}
+	writers := make([]*layerWriter, len(layerConfs)+1)
+	defer func() {
+		for _, lw := range writers {
+			if lw != nil {
+				lw.w.Close()
+			}
+		}
+	}()
 
-	for i, e := range manifest {
-		for j, tag := range e.RepoTags {
-			e.RepoTags[j] = joinRepoTag(splitRepoTag(tag))
+	if len(layerConfs) == 0 {
+		writers[0], err = newLayerWriter(spool, "")
+		if err != nil {
+			return nil, err
 		}
-		manifest[i] = e
 	}
 
-	return json.Marshal(&manifest)
-}
-
-func mkImageArchive(conf *Config, manifest, imageConf, layerTar []byte) ([]byte, error) {
 	var (
-		tarBuf bytes.Buffer
-		w      = tar.NewWriter(&tarBuf)
-		err    error
+		excludedDir string
+		linked      = map[string]*tar.Header{}
 	)
 
-	err = w.WriteHeader(&tar.Header{
-		Name:     "manifest.json",
-		Typeflag: tar.TypeReg,
-		Mode:     0644,
-		Size:     int64(len(manifest)),
-	})
-	if err != nil {
-		return nil, err
-	}
-	_, err = io.Copy(w, bytes.NewReader(manifest))
-	if err != nil {
-		return nil, err
-	}
+	r := tar.NewReader(src)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
 
-	err = w.WriteHeader(&tar.Header{
-		Name:     conf.imageID + ".json",
-		Typeflag: tar.TypeReg,
-		Mode:     0644,
-		Size:     int64(len(imageConf)),
-	})
-	if err != nil {
-		return nil, err
-	}
-	_, err = io.Copy(w, bytes.NewReader(imageConf))
-	if err != nil {
-		return nil, err
-	}
+		if !normalizeHeader(hdr) || hdr.Name == ".docker.json" || hdr.Name == ignoreFile {
+			continue
+		}
 
-	err = w.WriteHeader(&tar.Header{
-		Name:     conf.diffID + "/layer.tar",
-		Typeflag: tar.TypeReg,
-		Mode:     0644,
-		Size:     int64(len(layerTar)),
-	})
-	if err != nil {
-		return nil, err
-	}
-	_, err = io.Copy(w, bytes.NewReader(layerTar))
-	if err != nil {
-		return nil, err
-	}
+		names := rules.links.group(hdr.Name)
+		if len(names) > 1 {
+			names = rules.exclude.filter(names)
+			switch {
+			case len(names) == 0:
+			case hdr.Typeflag != tar.TypeLink:
+				hdr.Name = names[0]
+			case hdr.Name == names[0]:
+				// written with the data of the excluded entry
+				continue
+			default:
+				hdr.Linkname = names[0]
+			}
+		}
 
-	err = w.WriteHeader(&tar.Header{
-		Name:     conf.diffID + "/VERSION",
-		Typeflag: tar.TypeReg,
-		Mode:     0644,
-		Size:     3,
-	})
-	if err != nil {
-		return nil, err
+		if rules.exclude.match(hdr.Name) {
+			// report an excluded directory once, not every file in it
+			if excludedDir == "" || !strings.HasPrefix(hdr.Name, excludedDir) {
+				if rules.verbose {
+					fmt.Fprintf(os.Stderr, "Excluding /%s\n", hdr.Name)
+				}
+				if strings.HasSuffix(hdr.Name, "/") {
+					excludedDir = hdr.Name
+				}
+			}
+			continue
+		}
+
+		if hdr.Typeflag == tar.TypeLink {
+			if data, ok := linked[hdr.Linkname]; ok {
+				hdr.Mode = hdr.Mode&^07777 | data.Mode&07777
+				hdr.Uid, hdr.Gid = data.Uid, data.Gid
+				hdr.Uname, hdr.Gname = data.Uname, data.Gname
+			}
+		} else {
+			rules.owners.apply(hdr, names)
+			err = rules.files.apply(hdr, names)
+			if err != nil {
+				return nil, err
+			}
+			if len(names) > 1 {
+				linked[hdr.Name] = hdr
+			}
+		}
+
+		idx := len(layerConfs)
+		for i, layerConf := range layerConfs {
+			if matchesAnyPrefix(hdr.Name, layerConf.Paths) {
+				idx = i
+				break
+			}
+		}
+
+		lw := writers[idx]
+		if lw == nil {
+			var comment string
+			if idx < len(layerConfs) {
+				comment = layerConfs[idx].Comment
+			}
+			lw, err = newLayerWriter(spool, comment)
+			if err != nil {
+				return nil, err
+			}
+			writers[idx] = lw
+		}
+
+		err = lw.tw.WriteHeader(hdr)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(lw.tw, r)
+		if err != nil {
+			return nil, err
+		}
 	}
-	_, err = io.Copy(w, strings.NewReader("1.0"))
-	if err != nil {
-		return nil, err
+
+	var layers []*layer
+	for i, lw := range writers {
+		if lw == nil {
+			continue
+		}
+		writers[i] = nil
+
+		l, err := lw.layer()
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, l)
 	}
 
-	err = w.WriteHeader(&tar.Header{
-		Name:     conf.diffID + "/json",
-		Typeflag: tar.TypeReg,
-		Mode:     0644,
-		Size:     2,
-	})
+	return layers, nil
+}
+
+func newLayerWriter(spool *dkrarchive.Spool, comment string) (*layerWriter, error) {
+	w, err := spool.Create()
 	if err != nil {
 		return nil, err
 	}
-	_, err = io.Copy(w, strings.NewReader("{}"))
+	return &layerWriter{w: w, tw: tar.NewWriter(w), comment: comment}, nil
+}
+
+func (lw *layerWriter) layer() (*layer, error) {
+	err := lw.tw.Close()
 	if err != nil {
+		lw.w.Close()
 		return nil, err
 	}
 
-	err = w.Close()
+	c, err := lw.w.Content()
 	if err != nil {
 		return nil, err
 	}
 
-	return tarBuf.Bytes(), nil
+	return &layer{Layer: dkrarchive.NewLayer(c), comment: lw.comment}, nil
 }
 
-func splitRepoTag(t string) (registry, repo, tag string) {
+func mkImageConfig(conf *Config) ([]byte, error) {
+	iconf := &imageConfig{
+		Created:      conf.imageTime,
+		Author:       conf.Author,
+		Architecture: conf.Architecture,
+		OS:           conf.OS,
+		Variant:      conf.Variant,
+		Config:       conf.Config,
+
+		RootFS: rootFSConfig{
+			Type: "layers",
+		},
+		History: conf.history,
+	}
+
+	var diffIDs string
+	for _, l := range conf.layers {
+		iconf.RootFS.DiffIDs = append(iconf.RootFS.DiffIDs, "sha256:"+l.DiffID)
+		diffIDs += l.DiffID
 
-	parts := strings.SplitN(t, "/", 3)
-	if len(parts) == 1 {
-		parts = []string{
-			"docker.io",
-			"library/",
-			parts[0],
+		if l.inherited {
+			continue
 		}
-	}
-	if len(parts) == 2 {
-		parts = []string{
-			"docker.io",
-			parts[0],
-			parts[1],
+
+		comment := l.comment
+		if comment == "" {
+			comment = "Created by dkr-package"
 		}
+
+		iconf.History = append(iconf.History, historyEntry{
+			Author:    conf.Author,
+			Created:   conf.imageTime,
+			CreatedBy: "/bin/sh -c #(nop) dkr-package",
+			Comment:   comment,
+		})
 	}
 
-	tagParts := strings.SplitN(parts[2], ":", 2)
-	if len(tagParts) == 1 {
-		parts = []string{
-			parts[0],
-			parts[1],
-			tagParts[0],
-			"latest",
-		}
+	if iconf.OS == "" {
+		iconf.OS = "linux"
 	}
-	if len(tagParts) == 2 {
-		parts = []string{
-			parts[0],
-			parts[1],
-			tagParts[0],
-			tagParts[1],
-		}
+	if iconf.Architecture == "" {
+		iconf.Architecture = "amd64"
 	}
 
-	registry = parts[0]
-	repo = strings.Join(parts[1:3], "/")
-	tag = parts[3]
-	return
-}
+	imageIDSum := sha256.Sum256([]byte(diffIDs + conf.imageTime.String()))
+	imageIDHex := hex.EncodeToString(imageIDSum[:])
+	iconf.ID = imageIDHex
 
-func joinRepoTag(reg, repo, tag string) string {
-	repo = strings.TrimPrefix(repo, "library/")
-	fullTag := repo + ":" + tag
-	if reg != "docker.io" {
-		fullTag = reg + "/" + fullTag
-	}
-	return fullTag
+	return json.Marshal(&iconf)
 }
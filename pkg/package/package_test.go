@@ -0,0 +1,109 @@
+package dkrpackage
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/fd/dkr-util/pkg/archive"
+)
+
+// testEntry is an entry of a test input. Directories end in a slash,
+// entries with a linkname are hard links and entries with a target are
+// symlinks.
+type testEntry struct {
+	name     string
+	body     string
+	linkname string
+	target   string
+	mode     int64
+	uid, gid int
+}
+
+func mkTar(t *testing.T, entries ...testEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: e.mode, Uid: e.uid, Gid: e.gid, Typeflag: tar.TypeReg, Size: int64(len(e.body))}
+		switch {
+		case e.linkname != "":
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, e.linkname, 0
+		case e.target != "":
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, e.target, 0
+		case e.name[len(e.name)-1] == '/':
+			hdr.Typeflag = tar.TypeDir
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+
+		err := tw.WriteHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.WriteString(tw, e.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// packageHeaders packages the inputs with conf and returns the headers of
+// the entries of every layer by path. Packaging errors are returned.
+func packageHeaders(t *testing.T, conf *Config, inputs ...io.Reader) (map[string]*tar.Header, error) {
+	spool, err := dkrarchive.NewSpool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	var ins []*input
+	for _, src := range inputs {
+		in, err := spoolInput(spool, src)
+		if err != nil {
+			return nil, err
+		}
+		ins = append(ins, in)
+	}
+
+	conf, err = mkLayers(spool, ins, conf, false)
+	if err != nil {
+		return nil, err
+	}
+
+	hdrs := map[string]*tar.Header{}
+	for _, l := range conf.layers {
+		r, err := l.Tar.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = io.Copy(ioutil.Discard, tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hdrs[hdr.Name] = hdr
+		}
+		r.Close()
+	}
+
+	return hdrs, nil
+}
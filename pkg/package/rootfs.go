@@ -0,0 +1,93 @@
+package dkrpackage
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// RootFS returns a rootfs tar stream of the files in dir. The stream is
+// written while it is read. Entries are sorted by path, files that are
+// hard linked to a file written before them become hard links and sockets
+// are left out. Headers are normalized like those of any other input, and
+// rules for any path of a hard link group apply to the whole group, so
+// which of the paths holds the data doesn't matter.
+func RootFS(dir string) io.ReadCloser {
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(writeRootFS(w, dir))
+	}()
+	return r
+}
+
+func writeRootFS(dst io.Writer, dir string) error {
+	var (
+		tw    = tar.NewWriter(dst)
+		links = map[fileID]string{}
+	)
+
+	// filepath.Walk visits the files in lexical order
+	err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		if rel == "." || info.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+
+		var target string
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err = os.Readlink(name)
+			if err != nil {
+				return err
+			}
+		}
+
+		hdr, err := tar.FileInfoHeader(info, target)
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+
+		if info.Mode().IsRegular() {
+			if id, ok := hardLinkID(info); ok {
+				if first, found := links[id]; found {
+					hdr.Typeflag = tar.TypeLink
+					hdr.Linkname = first
+					hdr.Size = 0
+				} else {
+					links[id] = rel
+				}
+			}
+		}
+
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil
+		}
+
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.CopyN(tw, f, hdr.Size)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
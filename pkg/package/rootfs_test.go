@@ -0,0 +1,145 @@
+package dkrpackage
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// mkRootFS creates a directory with the given files. Files whose content
+// starts with "=" are hard links to the named file.
+func mkRootFS(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "dkr-rootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var links []string
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		err = os.MkdirAll(filepath.Dir(p), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(content) > 0 && content[0] == '=' {
+			links = append(links, name)
+			continue
+		}
+		err = ioutil.WriteFile(p, []byte(content), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range links {
+		err = os.Link(filepath.Join(dir, filepath.FromSlash(files[name][1:])), filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+func TestRootFSOrder(t *testing.T) {
+	dir := mkRootFS(t, map[string]string{
+		"b/z":   "z",
+		"a":     "a",
+		"b/a/c": "c",
+		"c":     "=a",
+	})
+	defer os.RemoveAll(dir)
+
+	r := RootFS(dir)
+	defer r.Close()
+
+	var names []string
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			names = append(names, hdr.Name+" -> "+hdr.Linkname)
+		} else {
+			names = append(names, hdr.Name)
+		}
+	}
+
+	expected := []string{"a", "b", "b/a", "b/a/c", "b/z", "c -> a"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected %q, got %q", expected, names)
+	}
+}
+
+func TestRootFSHardLinks(t *testing.T) {
+	// bin/hard comes first, so it holds the data of the group
+	dir := mkRootFS(t, map[string]string{
+		"bin/hello": "hello",
+		"bin/hard":  "=bin/hello",
+	})
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name     string
+		conf     *Config
+		data     string
+		link     string
+		uid, gid int
+		mode     int64
+	}{
+		{
+			name: "owner rule on the link",
+			conf: &Config{Ownership: &OwnershipConfig{Rules: []OwnerRule{{Paths: []string{"/bin/hello"}, Owner: "5:6"}}}},
+			data: "bin/hard", link: "bin/hello", uid: 5, gid: 6, mode: 0755,
+		},
+		{
+			name: "file rule on the link",
+			conf: &Config{Files: []FileConfig{{Paths: []string{"/bin/hello"}, Mode: "4711"}}},
+			data: "bin/hard", link: "bin/hello", mode: 04711,
+		},
+		{
+			name: "data entry excluded",
+			conf: &Config{Exclude: []string{"/bin/hard"}, Files: []FileConfig{{Paths: []string{"/bin/hard"}, Mode: "4711"}}},
+			data: "bin/hello", mode: 0755,
+		},
+	}
+
+	for _, test := range tests {
+		r := RootFS(dir)
+		hdrs, err := packageHeaders(t, test.conf, r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		data := hdrs[test.data]
+		if data == nil || data.Typeflag != tar.TypeReg || data.Size != int64(len("hello")) {
+			t.Fatalf("%s: expected the data in %s, got %+v", test.name, test.data, data)
+		}
+
+		check := []*tar.Header{data}
+		if test.link != "" {
+			link := hdrs[test.link]
+			if link == nil || link.Typeflag != tar.TypeLink || link.Linkname != test.data {
+				t.Fatalf("%s: expected %s to link to %s, got %+v", test.name, test.link, test.data, link)
+			}
+			check = append(check, link)
+		} else if len(hdrs) != 2 {
+			t.Fatalf("%s: expected only bin/ and %s, got %d entries", test.name, test.data, len(hdrs))
+		}
+
+		for _, hdr := range check {
+			if hdr.Uid != test.uid || hdr.Gid != test.gid || hdr.Mode&07777 != test.mode {
+				t.Fatalf("%s: expected %s to be %o %d:%d, got %o %d:%d", test.name, hdr.Name, test.mode, test.uid, test.gid, hdr.Mode&07777, hdr.Uid, hdr.Gid)
+			}
+		}
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package dkrpackage
+
+import (
+	"os"
+	"syscall"
+)
+
+type fileID struct {
+	dev, ino uint64
+}
+
+// hardLinkID returns the device and inode of a file with several links.
+func hardLinkID(info os.FileInfo) (fileID, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
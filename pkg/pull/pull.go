@@ -0,0 +1,180 @@
+package dkrpull
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/fd/dkr-util/pkg/archive"
+	"github.com/fd/dkr-util/pkg/registry"
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+// Options control how images are pulled.
+type Options struct {
+	// Format of the output archive. Defaults to dkrarchive.FormatDocker.
+	// Multi-platform images are always written as an OCI image layout.
+	Format string
+
+	// Platform selects one image of a multi-platform image. When it is nil
+	// the images of all platforms are pulled.
+	Platform *dkrarchive.Platform
+
+	// Registry holds the connection settings for the registry.
+	Registry dkrregistry.Config
+}
+
+type imageConfig struct {
+	RootFS struct {
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// Pull downloads an image from a registry and writes it to dst as an image
+// archive. All blobs are verified against their digests. Layers are
+// downloaded to temporary files. Manifest lists and image indexes are
+// pulled as multi-platform images, unless a platform is selected.
+func Pull(dst io.Writer, name string, opts Options) error {
+	ref := dkrregistry.ParseRef(name)
+
+	spool, err := dkrarchive.NewSpool()
+	if err != nil {
+		return err
+	}
+	defer spool.Close()
+
+	fmt.Fprintf(os.Stderr, "Pulling %s\n", ref)
+
+	hub, err := dkrregistry.Dial(ref.Registry, opts.Registry)
+	if err != nil {
+		return err
+	}
+
+	mediaType, data, err := dkrregistry.GetManifestOrIndex(hub, ref.Repo, ref.Reference())
+	if err != nil {
+		return err
+	}
+
+	var tags []string
+	if ref.Tag != "" {
+		tags = []string{dkrregistry.Ref{Registry: ref.Registry, Repo: ref.Repo, Tag: ref.Tag}.String()}
+	}
+
+	if !dkrarchive.IsIndex(mediaType) {
+		img, err := pullImage(hub, spool, ref.Repo, mediaType, data)
+		if err != nil {
+			return err
+		}
+		img.RepoTags = tags
+		return dkrarchive.Write(dst, opts.Format, spool, img)
+	}
+
+	var index dkrarchive.Index
+	err = json.Unmarshal(data, &index)
+	if err != nil {
+		return err
+	}
+
+	idx := &dkrarchive.ImageIndex{RepoTags: tags}
+	for _, desc := range index.Manifests {
+		// skip nested indexes and the attestations buildx adds to indexes
+		if dkrarchive.IsIndex(desc.MediaType) || desc.Platform == nil || desc.Platform.OS == "unknown" {
+			continue
+		}
+		if opts.Platform != nil && !matchPlatform(opts.Platform, desc.Platform) {
+			continue
+		}
+
+		fmt.Fprintf(os.Stderr, "Pulling platform %s\n", desc.Platform)
+
+		imgType, imgData, err := dkrregistry.GetManifest(hub, ref.Repo, desc.Digest.String())
+		if err != nil {
+			return err
+		}
+		img, err := pullImage(hub, spool, ref.Repo, imgType, imgData)
+		if err != nil {
+			return err
+		}
+		img.Platform = desc.Platform
+
+		if opts.Platform != nil {
+			img.RepoTags = tags
+			return dkrarchive.Write(dst, opts.Format, spool, img)
+		}
+		idx.Images = append(idx.Images, img)
+	}
+
+	if opts.Platform != nil {
+		return fmt.Errorf("%s has no image for platform %s", ref, opts.Platform)
+	}
+	if len(idx.Images) == 0 {
+		return fmt.Errorf("%s has no images", ref)
+	}
+
+	return dkrarchive.WriteIndexes(dst, spool, idx)
+}
+
+// matchPlatform reports whether an image for platform p satisfies the
+// selected platform. The variant only matters when one is selected.
+func matchPlatform(selected, p *dkrarchive.Platform) bool {
+	if selected.OS != p.OS || selected.Architecture != p.Architecture {
+		return false
+	}
+	return selected.Variant == "" || selected.Variant == p.Variant
+}
+
+// pullImage downloads the config and layers of an image manifest.
+func pullImage(hub *registry.Registry, spool *dkrarchive.Spool, repo, mediaType string, data []byte) (*dkrarchive.Image, error) {
+	switch mediaType {
+	case dkrarchive.MediaTypeManifestV2, dkrarchive.MediaTypeOCIManifest:
+	default:
+		return nil, fmt.Errorf("unsupported manifest type %q", mediaType)
+	}
+
+	var mani dkrarchive.Manifest
+	err := json.Unmarshal(data, &mani)
+	if err != nil {
+		return nil, err
+	}
+
+	configBlob, err := dkrregistry.GetBlob(hub, spool, repo, mani.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	config, err := configBlob.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var iconf imageConfig
+	err = json.Unmarshal(config, &iconf)
+	if err != nil {
+		return nil, err
+	}
+	if len(iconf.RootFS.DiffIDs) != len(mani.Layers) {
+		return nil, fmt.Errorf("image config has %d diff IDs for %d layers", len(iconf.RootFS.DiffIDs), len(mani.Layers))
+	}
+
+	img := &dkrarchive.Image{Config: config}
+	for i, layerDesc := range mani.Layers {
+		fmt.Fprintf(os.Stderr, "Downloading layer %s\n", layerDesc.Digest.Hex())
+
+		blob, err := dkrregistry.GetBlob(hub, spool, repo, layerDesc.Digest)
+		if err != nil {
+			return nil, err
+		}
+
+		l, err := dkrarchive.DecodeLayer(spool, layerDesc.MediaType, blob)
+		if err != nil {
+			return nil, err
+		}
+		if "sha256:"+l.DiffID != iconf.RootFS.DiffIDs[i] {
+			return nil, fmt.Errorf("layer %s has diff ID sha256:%s, expected %s", layerDesc.Digest, l.DiffID, iconf.RootFS.DiffIDs[i])
+		}
+
+		img.Layers = append(img.Layers, l)
+	}
+
+	return img, nil
+}
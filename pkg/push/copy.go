@@ -0,0 +1,146 @@
+package dkrpush
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/docker/distribution/digest"
+	"github.com/fd/dkr-util/pkg/archive"
+	"github.com/fd/dkr-util/pkg/registry"
+)
+
+// Copy copies an image (or multi-platform image) from one registry
+// reference to another. Blobs are streamed from the source registry, so
+// nothing is stored locally. Manifests are pushed unchanged and keep their
+// digests. Blobs are mounted when both references are on the same registry.
+// The result has the digest of the destination tag.
+func Copy(srcName, dstName string, opts Options) (*Result, error) {
+	var (
+		start  = time.Now()
+		result = newResult()
+	)
+
+	if opts.Schema1 {
+		return nil, errors.New("copy can't convert manifests to schema 1")
+	}
+
+	src := dkrregistry.ParseRef(srcName)
+	dst := dkrregistry.ParseRef(dstName)
+	if dst.Digest != "" {
+		return nil, fmt.Errorf("destination %s must be a tag", dstName)
+	}
+
+	logf("Copying %s to %s\n", src, dst)
+
+	srcHub, err := dkrregistry.Dial(src.Registry, opts.Registry)
+	if err != nil {
+		return nil, err
+	}
+
+	dstHub := srcHub
+	if dst.Registry != src.Registry {
+		dstHub, err = dkrregistry.Dial(dst.Registry, opts.Registry)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	mediaType, data, err := dkrregistry.GetManifestOrIndex(srcHub, src.Repo, src.Reference())
+	if err != nil {
+		return nil, err
+	}
+
+	repo := &pushRepo{
+		Ref:    dst,
+		seen:   map[digest.Digest]bool{},
+		source: &blobSource{hub: srcHub, repo: src.Repo},
+	}
+
+	if dkrarchive.IsIndex(mediaType) {
+		var index dkrarchive.Index
+		err = json.Unmarshal(data, &index)
+		if err != nil {
+			return nil, err
+		}
+
+		var images []*dkrarchive.PushManifest
+		for _, desc := range index.Manifests {
+			imgType, imgData, err := dkrregistry.GetManifest(srcHub, src.Repo, desc.Digest.String())
+			if err != nil {
+				return nil, err
+			}
+
+			mani, err := remoteManifest(imgType, imgData)
+			if err != nil {
+				return nil, err
+			}
+			images = append(images, mani)
+			repo.addRemoteBlobs(mani)
+		}
+
+		repo.tags = append(repo.tags, pushTag{
+			tag:    dst.Tag,
+			mani:   &dkrarchive.PushManifest{MediaType: mediaType, Data: data, Digest: dkrarchive.Bytes(data).Digest},
+			images: images,
+		})
+	} else {
+		mani, err := remoteManifest(mediaType, data)
+		if err != nil {
+			return nil, err
+		}
+		repo.tags = append(repo.tags, pushTag{tag: dst.Tag, mani: mani})
+		repo.addRemoteBlobs(mani)
+	}
+
+	sess := &registrySession{hub: dstHub, blobs: map[digest.Digest]string{}}
+	if dst.Registry == src.Registry {
+		for _, blob := range repo.blobs {
+			sess.addBlob(blob.Digest, src.Repo)
+		}
+	}
+
+	err = repo.push(sess, opts, result)
+	if err != nil {
+		return nil, err
+	}
+
+	result.finish(start)
+	return result, nil
+}
+
+// remoteManifest returns the manifest of an image in a registry with the
+// blobs it refers to, without their content.
+func remoteManifest(mediaType string, data []byte) (*dkrarchive.PushManifest, error) {
+	switch mediaType {
+	case dkrarchive.MediaTypeManifestV2, dkrarchive.MediaTypeOCIManifest:
+	default:
+		return nil, fmt.Errorf("unsupported manifest type %q", mediaType)
+	}
+
+	var mani dkrarchive.Manifest
+	err := json.Unmarshal(data, &mani)
+	if err != nil {
+		return nil, err
+	}
+
+	pm := &dkrarchive.PushManifest{
+		MediaType: mediaType,
+		Data:      data,
+		Digest:    dkrarchive.Bytes(data).Digest,
+		Config:    &dkrarchive.Blob{Descriptor: mani.Config},
+	}
+	for _, desc := range mani.Layers {
+		pm.Layers = append(pm.Layers, &dkrarchive.Blob{Descriptor: desc})
+	}
+
+	return pm, nil
+}
+
+func (r *pushRepo) addRemoteBlobs(mani *dkrarchive.PushManifest) {
+	for _, layer := range mani.Layers {
+		r.addBlob(layer, layer.Digest.Hex())
+	}
+	r.addBlob(mani.Config, "")
+}
@@ -1,301 +1,477 @@
 package dkrpush
 
 import (
-	"archive/tar"
-	"bytes"
-	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"net/http"
 	"os"
-	"strings"
-
-	"golang.org/x/net/context"
-	"golang.org/x/oauth2/google"
+	"sync"
+	"time"
 
 	"github.com/docker/distribution/digest"
 	"github.com/docker/distribution/manifest"
 	"github.com/docker/libtrust"
-	"github.com/fsouza/go-dockerclient"
+	"github.com/fd/dkr-util/pkg/archive"
+	"github.com/fd/dkr-util/pkg/registry"
 	"github.com/heroku/docker-registry-client/registry"
 )
 
-type manifestEntry struct {
-	Config   string
-	RepoTags []string
-	Layers   []string
+// Options control how images are pushed to the registry.
+type Options struct {
+	// Schema1 pushes signed schema 1 manifests instead of schema 2 manifests.
+	// Only use this for registries that don't support schema 2 yet.
+	Schema1 bool
+
+	// Jobs is the number of blobs uploaded concurrently. Defaults to 1.
+	Jobs int
+
+	// Upload controls the chunked blob uploads.
+	Upload dkrregistry.UploadOptions
+
+	// Registry holds the connection settings for the registries.
+	Registry dkrregistry.Config
 }
 
-func Push(src io.Reader) error {
-	manifestEntries, images, layers, err := extractTar(src)
+// Push pushes all images of an archive to the registries of their repo
+// tags. Blobs are uploaded once per repository, opts.Jobs at a time, and
+// every tag is pushed as a manifest. For multi-platform images the
+// manifests of the platforms are pushed by digest before the index.
+// The result lists the digest of every pushed tag.
+func Push(src io.Reader, opts Options) (*Result, error) {
+	var (
+		start  = time.Now()
+		result = newResult()
+	)
+
+	spool, err := dkrarchive.NewSpool()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer spool.Close()
 
-	key, err := libtrust.GenerateECP256PrivateKey()
+	a, err := dkrarchive.Read(src, spool)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	for _, manifestEntry := range manifestEntries {
-		for _, fullTag := range manifestEntry.RepoTags {
-			reg, repo, tag := splitRepoTag(fullTag)
-			regURL := registryNameToURL(reg)
-			username, password, err := getRegCreds(regURL)
-			if err != nil {
-				return err
-			}
-
-			hub := &registry.Registry{
-				URL:  regURL,
-				Logf: registry.Quiet,
-				// Logf: registry.Log,
-				Client: &http.Client{
-					Transport: wrapTransport(http.DefaultTransport, regURL, username, password),
-				},
-			}
-
-			fmt.Fprintf(os.Stderr, "Pushing %s/%s:%s\n", reg, repo, tag)
+	if a.Index != nil && opts.Schema1 {
+		return nil, errors.New("schema 1 manifests can't be pushed from an OCI image layout")
+	}
 
-			if err := hub.Ping(); err != nil {
-				return err
-			}
+	images, err := a.ReadImages(spool)
+	if err != nil {
+		return nil, err
+	}
 
-			fsLayers, err := uploadLayers(hub, repo, manifestEntry, layers)
-			if err != nil {
-				return err
-			}
+	indexes, err := a.ReadIndexes(spool)
+	if err != nil {
+		return nil, err
+	}
 
-			mani := &manifest.Manifest{
-				Versioned: manifest.Versioned{
-					SchemaVersion: 1,
-				},
-				Name:     repo,
-				Tag:      tag,
-				FSLayers: fsLayers,
-				History: []manifest.History{
-					{V1Compatibility: string(images[strings.TrimSuffix(manifestEntry.Config, ".json")])},
-				},
-			}
+	var (
+		repos  []*pushRepo
+		byName = map[string]*pushRepo{}
+	)
 
-			signedManifest, err := manifest.Sign(mani, key)
-			if err != nil {
-				return err
-			}
+	repoFor := func(fullTag string) (*pushRepo, string) {
+		ref := dkrregistry.ParseRef(fullTag)
 
-			err = hub.PutManifest(mani.Name, mani.Tag, signedManifest)
-			if err != nil {
-				return err
-			}
+		repo := byName[ref.Name()]
+		if repo == nil {
+			repo = &pushRepo{Ref: ref, seen: map[digest.Digest]bool{}}
+			byName[ref.Name()] = repo
+			repos = append(repos, repo)
 		}
+		return repo, ref.Tag
 	}
 
-	return nil
-}
-
-func uploadLayers(hub *registry.Registry, repoName string, manifestEntry manifestEntry, layers map[string][]byte) ([]manifest.FSLayer, error) {
-	var fsLayers []manifest.FSLayer
-
-	for _, layerPath := range manifestEntry.Layers {
-		var (
-			layerID   = strings.TrimSuffix(layerPath, "/layer.tar")
-			layerData = layers[layerID]
-			zdata     []byte
-		)
+	for _, img := range images {
+		mani, err := img.PushManifest(spool)
+		if err != nil {
+			return nil, err
+		}
 
-		{
-			var zbuf bytes.Buffer
-			zw := gzip.NewWriter(&zbuf)
-			io.Copy(zw, bytes.NewReader(layerData))
-			zw.Close()
-			zdata = zbuf.Bytes()
+		for _, fullTag := range img.RepoTags {
+			repo, tag := repoFor(fullTag)
+			repo.addTag(tag, img, mani)
 		}
+	}
 
-		layerDigest, err := digest.FromBytes(zdata)
+	for _, idx := range indexes {
+		mani, imageManis, err := idx.PushManifest(spool)
 		if err != nil {
 			return nil, err
 		}
 
-		exists, err := hub.HasLayer(repoName, layerDigest)
-		if err != nil {
-			return nil, err
+		for _, fullTag := range idx.RepoTags {
+			repo, tag := repoFor(fullTag)
+			repo.addIndex(tag, idx, mani, imageManis)
 		}
-		if exists {
-			fmt.Fprintf(os.Stderr, "Existing layer  %s\n", layerID)
-			fsLayers = append(fsLayers, manifest.FSLayer{layerDigest})
-			continue
+	}
+
+	sessions := map[string]*registrySession{}
+	for _, repo := range repos {
+		sess := sessions[repo.Registry]
+		if sess == nil {
+			hub, err := dkrregistry.Dial(repo.Registry, opts.Registry)
+			if err != nil {
+				return nil, err
+			}
+			sess = &registrySession{hub: hub, blobs: map[digest.Digest]string{}}
+			sessions[repo.Registry] = sess
 		}
 
-		fmt.Fprintf(os.Stderr, "Uploading layer %s\n", layerID)
-		err = hub.UploadLayer(repoName, layerDigest, bytes.NewReader(zdata))
+		err = repo.push(sess, opts, result)
 		if err != nil {
 			return nil, err
 		}
+	}
+
+	result.finish(start)
+	return result, nil
+}
 
-		fsLayers = append(fsLayers, manifest.FSLayer{layerDigest})
+// registrySession is the connection to a registry, shared by all
+// repositories pushed to it. It remembers which repository holds each blob
+// so that other repositories can mount the blob instead of uploading it.
+type registrySession struct {
+	hub *registry.Registry
+
+	mu    sync.Mutex
+	blobs map[digest.Digest]string
+}
+
+// blobRepo returns a repository known to hold the blob, if any.
+func (s *registrySession) blobRepo(d digest.Digest) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.blobs[d]
+}
+
+func (s *registrySession) addBlob(d digest.Digest, repo string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.blobs[d] == "" {
+		s.blobs[d] = repo
 	}
+}
 
-	return fsLayers, nil
+// pushRepo collects the tags and blobs that are pushed to a repository.
+type pushRepo struct {
+	dkrregistry.Ref
+	tags  []pushTag
+	blobs []pushBlob
+	seen  map[digest.Digest]bool
+
+	// source is the repository the blobs are copied from. Blobs of images
+	// read from an archive have their content instead.
+	source *blobSource
 }
 
-func extractTar(src io.Reader) (manifest []manifestEntry, images, layers map[string][]byte, err error) {
-	layers = map[string][]byte{}
-	images = map[string][]byte{}
+// blobSource is a repository blobs are streamed from.
+type blobSource struct {
+	hub  *registry.Registry
+	repo string
+}
 
-	r := tar.NewReader(src)
-	for {
-		hdr, err := r.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, nil, nil, err
-		}
+type pushTag struct {
+	tag  string
+	mani *dkrarchive.PushManifest
 
-		if len(hdr.Name) == 64+len("/layer.tar") && strings.HasSuffix(hdr.Name, "/layer.tar") {
-			layerID := strings.TrimSuffix(hdr.Name, "/layer.tar")
+	// images are the platform manifests of an index.
+	images []*dkrarchive.PushManifest
+}
 
-			data, err := ioutil.ReadAll(r)
-			if err != nil {
-				return nil, nil, nil, err
-			}
-			layers[layerID] = data
-		}
+type pushBlob struct {
+	*dkrarchive.Blob
+	layerID string
+}
 
-		if len(hdr.Name) == 64+5 && strings.HasSuffix(hdr.Name, ".json") {
-			imageID := strings.TrimSuffix(hdr.Name, ".json")
+func (r *pushRepo) addTag(tag string, img *dkrarchive.Image, mani *dkrarchive.PushManifest) {
+	r.tags = append(r.tags, pushTag{tag: tag, mani: mani})
+	r.addBlobs(img, mani)
+}
 
-			data, err := ioutil.ReadAll(r)
-			if err != nil {
-				return nil, nil, nil, err
-			}
-			images[imageID] = data
-		}
+func (r *pushRepo) addIndex(tag string, idx *dkrarchive.ImageIndex, mani *dkrarchive.PushManifest, images []*dkrarchive.PushManifest) {
+	r.tags = append(r.tags, pushTag{tag: tag, mani: mani, images: images})
+	for i, img := range idx.Images {
+		r.addBlobs(img, images[i])
+	}
+}
 
-		if hdr.Name == "manifest.json" {
-			data, err := ioutil.ReadAll(r)
-			if err != nil {
-				return nil, nil, nil, err
+func (r *pushRepo) addBlobs(img *dkrarchive.Image, mani *dkrarchive.PushManifest) {
+	for i, layer := range mani.Layers {
+		r.addBlob(layer, img.Layers[i].DiffID)
+	}
+	r.addBlob(mani.Config, "")
+}
+
+func (r *pushRepo) addBlob(blob *dkrarchive.Blob, layerID string) {
+	if r.seen[blob.Digest] {
+		return
+	}
+	r.seen[blob.Digest] = true
+	r.blobs = append(r.blobs, pushBlob{Blob: blob, layerID: layerID})
+}
+
+func (r *pushRepo) push(sess *registrySession, opts Options, result *Result) error {
+	for _, t := range r.tags {
+		logf("Pushing %s/%s:%s\n", r.Registry, r.Repo, t.tag)
+	}
+
+	err := r.uploadBlobs(sess, opts, result)
+	if err != nil {
+		return err
+	}
+
+	pushed := map[digest.Digest]bool{}
+	for _, t := range r.tags {
+		for _, img := range t.images {
+			if pushed[img.Digest] {
+				continue
 			}
-			err = json.Unmarshal(data, &manifest)
+			pushed[img.Digest] = true
+
+			_, err = dkrregistry.PutManifest(sess.hub, r.Repo, img.Digest.String(), img.MediaType, img.Data)
 			if err != nil {
-				return nil, nil, nil, err
+				return err
 			}
 		}
 
-		io.Copy(ioutil.Discard, r)
+		var (
+			d         digest.Digest
+			mediaType = t.mani.MediaType
+		)
+		if opts.Schema1 {
+			d, err = putManifestV1(sess.hub, r.Repo, t.tag, t.mani)
+			mediaType = dkrarchive.MediaTypeManifestV1Sig
+		} else {
+			d, err = dkrregistry.PutManifest(sess.hub, r.Repo, t.tag, mediaType, t.mani.Data)
+		}
+		if err != nil {
+			return err
+		}
+
+		tagRef := dkrregistry.Ref{Registry: r.Registry, Repo: r.Repo, Tag: t.tag}
+		pinned := dkrregistry.Ref{Registry: r.Registry, Repo: r.Repo, Digest: d.String()}
+		logf("Pushed %s as %s\n", tagRef, pinned)
+		result.addTag(TagResult{Tag: tagRef.String(), Ref: pinned.String(), Digest: d, MediaType: mediaType})
 	}
 
-	return manifest, images, layers, nil
+	return nil
 }
 
-func splitRepoTag(t string) (registry, repo, tag string) {
+// uploadBlobs uploads the blobs of the repository with opts.Jobs uploads
+// running at a time. No new uploads are started after the first failure.
+func (r *pushRepo) uploadBlobs(sess *registrySession, opts Options, result *Result) error {
+	jobs := opts.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
 
-	parts := strings.SplitN(t, "/", 3)
-	if len(parts) == 1 {
-		parts = []string{
-			"docker.io",
-			"library/",
-			parts[0],
-		}
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		queue    = make(chan pushBlob)
+	)
+
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
 	}
-	if len(parts) == 2 {
-		parts = []string{
-			"docker.io",
-			parts[0],
-			parts[1],
-		}
+
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for blob := range queue {
+				status, err := uploadBlob(sess, r.Repo, blob.layerID, blob.Blob, r.source, opts.Upload)
+				if err == nil {
+					result.addBlob(BlobResult{
+						Repository: r.Ref.Name(),
+						Digest:     blob.Digest,
+						Size:       blob.Size,
+						Layer:      blob.layerID != "",
+						Status:     status,
+					})
+				}
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
 	}
 
-	tagParts := strings.SplitN(parts[2], ":", 2)
-	if len(tagParts) == 1 {
-		parts = []string{
-			parts[0],
-			parts[1],
-			tagParts[0],
-			"latest",
+	for _, blob := range r.blobs {
+		if failed() {
+			break
 		}
+		queue <- blob
+	}
+	close(queue)
+	wg.Wait()
+
+	return firstErr
+}
+
+func putManifestV1(hub *registry.Registry, repo, tag string, pm *dkrarchive.PushManifest) (digest.Digest, error) {
+	key, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		return "", err
 	}
-	if len(tagParts) == 2 {
-		parts = []string{
-			parts[0],
-			parts[1],
-			tagParts[0],
-			tagParts[1],
+
+	// schema 1 lists the layers from top to bottom, each with a v1 image.
+	// Only the top layer carries the image config, the layers below it get
+	// synthetic IDs chained to their parent.
+	var (
+		n        = len(pm.Layers)
+		fsLayers = make([]manifest.FSLayer, n)
+		history  = make([]manifest.History, n)
+		parent   string
+	)
+	for i, desc := range pm.Layers {
+		fsLayers[n-1-i] = manifest.FSLayer{BlobSum: desc.Digest}
+
+		var v1Image []byte
+		if i == n-1 {
+			var config []byte
+			config, err = pm.Config.Content.ReadAll()
+			if err == nil {
+				v1Image, err = setV1Parent(config, parent)
+			}
+		} else {
+			id := sha256.Sum256([]byte(parent + " " + desc.Digest.String()))
+			v1Image, err = json.Marshal(&v1Layer{ID: hex.EncodeToString(id[:]), Parent: parent})
+			parent = hex.EncodeToString(id[:])
+		}
+		if err != nil {
+			return "", err
 		}
+
+		history[n-1-i] = manifest.History{V1Compatibility: string(v1Image)}
 	}
 
-	registry = parts[0]
-	repo = strings.Join(parts[1:3], "/")
-	tag = parts[3]
-	return
-}
+	mani := &manifest.Manifest{
+		Versioned: manifest.Versioned{
+			SchemaVersion: 1,
+		},
+		Name:     repo,
+		Tag:      tag,
+		FSLayers: fsLayers,
+		History:  history,
+	}
+
+	signedManifest, err := manifest.Sign(mani, key)
+	if err != nil {
+		return "", err
+	}
+
+	err = hub.PutManifest(mani.Name, mani.Tag, signedManifest)
+	if err != nil {
+		return "", err
+	}
 
-func registryNameToURL(name string) string {
-	if name == "docker.io" {
-		return "https://index.docker.io"
+	// the digest of a signed manifest excludes the signatures
+	payload, err := signedManifest.Payload()
+	if err != nil {
+		return "", err
 	}
-	return "https://" + name
+	return digest.FromBytes(payload)
+}
+
+type v1Layer struct {
+	ID     string `json:"id"`
+	Parent string `json:"parent,omitempty"`
 }
 
-func getRegCreds(url string) (username, password string, err error) {
-	if os.Getenv("DKR_USERNAME") != "" {
-		return os.Getenv("DKR_USERNAME"), os.Getenv("DKR_PASSWORD"), nil
+func setV1Parent(imageConf []byte, parent string) ([]byte, error) {
+	if parent == "" {
+		return imageConf, nil
 	}
 
-	if strings.Contains(url, "gcr.io") {
-		ts, err := google.DefaultTokenSource(context.Background())
-		if err != nil {
-			return "", "", err
-		}
+	var v1Image map[string]json.RawMessage
+	err := json.Unmarshal(imageConf, &v1Image)
+	if err != nil {
+		return nil, err
+	}
 
-		token, err := ts.Token()
-		if err != nil {
-			return "", "", err
-		}
+	v1Image["parent"], err = json.Marshal(parent)
+	if err != nil {
+		return nil, err
+	}
 
-		return "_token", token.AccessToken, nil
+	return json.Marshal(v1Image)
+}
+
+// uploadBlob uploads a blob unless the repository already has it. Blobs
+// that another repository of the session holds are mounted from there.
+// Without content the blob is streamed from source. Progress is reported
+// for blobs with a layerID. It returns how the repository got the blob.
+func uploadBlob(sess *registrySession, repoName, layerID string, blob *dkrarchive.Blob, source *blobSource, opts dkrregistry.UploadOptions) (string, error) {
+	if blob.Content == nil && source == nil {
+		return "", fmt.Errorf("missing blob %s", blob.Digest)
 	}
 
-	if os.Getenv("HOME") != "" {
-		auth, err := docker.NewAuthConfigurationsFromDockerCfg()
-		if err != nil {
-			return "", "", err
+	hub := sess.hub
+	exists, err := hub.HasLayer(repoName, blob.Digest)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		sess.addBlob(blob.Digest, repoName)
+		if layerID != "" {
+			logf("Existing layer  %s\n", layerID)
 		}
+		return BlobExisting, nil
+	}
 
-		creds, f := auth.Configs[url]
-		if f {
-			return creds.Username, creds.Password, nil
+	if from := sess.blobRepo(blob.Digest); from != "" {
+		mounted, err := dkrregistry.MountBlob(hub, repoName, blob.Digest, from)
+		if err != nil {
+			hub.Logf("registry.blob.mount-failed repository=%s digest=%s from=%s err=%s", repoName, blob.Digest, from, err)
 		}
-
-		if url == "https://index.docker.io" {
-			creds, f := auth.Configs["https://index.docker.io/v1/"]
-			if f {
-				return creds.Username, creds.Password, nil
+		if mounted {
+			if layerID != "" {
+				logf("Mounted layer   %s from %s\n", layerID, from)
 			}
+			return BlobMounted, nil
 		}
 	}
 
-	return "", "", errors.New("not logged in")
-}
-
-func wrapTransport(transport http.RoundTripper, url, username, password string) http.RoundTripper {
-	tokenTransport := &registry.TokenTransport{
-		Transport: transport,
-		Username:  username,
-		Password:  password,
+	if layerID != "" {
+		logf("Uploading layer %s\n", layerID)
 	}
-	basicAuthTransport := &registry.BasicTransport{
-		Transport: tokenTransport,
-		URL:       url,
-		Username:  username,
-		Password:  password,
+	if blob.Content != nil {
+		err = dkrregistry.UploadBlob(hub, repoName, blob.Digest, blob.Content, opts)
+	} else {
+		err = dkrregistry.CopyBlob(hub, repoName, source.hub, source.repo, blob.Digest, blob.Size, opts)
 	}
-	errorTransport := &registry.ErrorTransport{
-		Transport: basicAuthTransport,
+	if err != nil {
+		return "", err
 	}
-	return errorTransport
+	sess.addBlob(blob.Digest, repoName)
+
+	if layerID != "" {
+		logf("Uploaded layer  %s\n", layerID)
+	}
+	return BlobUploaded, nil
+}
+
+var logMu sync.Mutex
+
+// logf prints a progress line. Lines of concurrent uploads don't
+// interleave.
+func logf(format string, args ...interface{}) {
+	logMu.Lock()
+	defer logMu.Unlock()
+	fmt.Fprintf(os.Stderr, format, args...)
 }
@@ -0,0 +1,86 @@
+package dkrpush
+
+import (
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/digest"
+)
+
+// Blob statuses of a push.
+const (
+	BlobUploaded = "uploaded"
+	BlobMounted  = "mounted"
+	BlobExisting = "existing"
+)
+
+// Result summarizes a push.
+type Result struct {
+	Tags  []TagResult  `json:"tags"`
+	Blobs []BlobResult `json:"blobs"`
+
+	LayersUploaded int `json:"layers_uploaded"`
+	LayersMounted  int `json:"layers_mounted"`
+	LayersExisting int `json:"layers_existing"`
+
+	// BytesUploaded is the size of the uploaded blobs.
+	BytesUploaded int64 `json:"bytes_uploaded"`
+
+	Duration float64 `json:"duration_seconds"`
+
+	mu sync.Mutex
+}
+
+// TagResult is a pushed tag with the digest the registry assigned to its
+// manifest. Ref pins the tag by digest.
+type TagResult struct {
+	Tag       string        `json:"tag"`
+	Ref       string        `json:"ref"`
+	Digest    digest.Digest `json:"digest"`
+	MediaType string        `json:"media_type"`
+}
+
+// BlobResult is a blob of a pushed repository.
+type BlobResult struct {
+	Repository string        `json:"repository"`
+	Digest     digest.Digest `json:"digest"`
+	Size       int64         `json:"size"`
+	Layer      bool          `json:"layer"`
+	Status     string        `json:"status"`
+}
+
+func newResult() *Result {
+	return &Result{Tags: []TagResult{}, Blobs: []BlobResult{}}
+}
+
+func (r *Result) addTag(t TagResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Tags = append(r.Tags, t)
+}
+
+func (r *Result) addBlob(b BlobResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Blobs = append(r.Blobs, b)
+	if b.Status == BlobUploaded {
+		r.BytesUploaded += b.Size
+	}
+	if !b.Layer {
+		return
+	}
+
+	switch b.Status {
+	case BlobUploaded:
+		r.LayersUploaded++
+	case BlobMounted:
+		r.LayersMounted++
+	case BlobExisting:
+		r.LayersExisting++
+	}
+}
+
+func (r *Result) finish(start time.Time) {
+	r.Duration = time.Since(start).Seconds()
+}
@@ -0,0 +1,215 @@
+package dkrregistry
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// dockerHubServer is the key docker uses for Docker Hub credentials.
+const dockerHubServer = "https://index.docker.io/v1/"
+
+// errNoCreds is returned by the credential lookups that have nothing for a
+// registry, so the next source can be tried.
+var errNoCreds = errors.New("no credentials")
+
+// identityTokenUser is the username credential helpers return for an
+// identity token (an OAuth2 refresh token) instead of a password. The
+// lookups return it the same way for identity tokens in config.json.
+const identityTokenUser = "<token>"
+
+// dockerConfig is the part of ~/.docker/config.json that holds credentials.
+type dockerConfig struct {
+	Auths       map[string]dockerAuth `json:"auths"`
+	CredsStore  string                `json:"credsStore"`
+	CredHelpers map[string]string     `json:"credHelpers"`
+}
+
+type dockerAuth struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+// envCreds returns the credentials from the USERNAME and PASSWORD
+// environment variables with a prefix, like DKR_LOCALHOST_5000_ for the
+// credentials of one registry or DKR_ for those of every registry.
+func envCreds(prefix string) (username, password string, err error) {
+	if os.Getenv(prefix+"USERNAME") != "" {
+		return os.Getenv(prefix + "USERNAME"), os.Getenv(prefix + "PASSWORD"), nil
+	}
+
+	return "", "", errNoCreds
+}
+
+// envName turns a registry host into the form used in environment variable
+// names: localhost:5000 becomes LOCALHOST_5000.
+func envName(reg string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, reg)
+}
+
+// dockerConfigCreds returns the credentials docker would use for a registry:
+// a credential helper from credHelpers, otherwise the credsStore, otherwise
+// the auths entry.
+func dockerConfigCreds(reg string) (username, password string, err error) {
+	conf, err := loadDockerConfig()
+	if err != nil {
+		return "", "", err
+	}
+
+	server := reg
+	if server == "docker.io" {
+		server = dockerHubServer
+	}
+
+	for key, helper := range conf.CredHelpers {
+		if normalizeRegistry(key) == reg {
+			return helperCreds(helper, server)
+		}
+	}
+
+	if conf.CredsStore != "" {
+		username, password, err = helperCreds(conf.CredsStore, server)
+		if err != errNoCreds {
+			return username, password, err
+		}
+	}
+
+	for key, auth := range conf.Auths {
+		if normalizeRegistry(key) == reg {
+			return auth.creds(key)
+		}
+	}
+
+	return "", "", errNoCreds
+}
+
+// loadDockerConfig reads config.json from $DOCKER_CONFIG or ~/.docker, or
+// the legacy ~/.dockercfg when there is no config.json.
+func loadDockerConfig() (*dockerConfig, error) {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		if os.Getenv("HOME") == "" {
+			return &dockerConfig{}, nil
+		}
+		dir = filepath.Join(os.Getenv("HOME"), ".docker")
+	}
+
+	var conf dockerConfig
+	data, err := ioutil.ReadFile(filepath.Join(dir, "config.json"))
+	if err == nil {
+		err = json.Unmarshal(data, &conf)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", filepath.Join(dir, "config.json"), err)
+		}
+		return &conf, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if os.Getenv("HOME") == "" {
+		return &conf, nil
+	}
+
+	legacy := filepath.Join(os.Getenv("HOME"), ".dockercfg")
+	data, err = ioutil.ReadFile(legacy)
+	if os.IsNotExist(err) {
+		return &conf, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &conf.Auths)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", legacy, err)
+	}
+	return &conf, nil
+}
+
+func (a dockerAuth) creds(server string) (username, password string, err error) {
+	if a.IdentityToken != "" {
+		return identityTokenUser, a.IdentityToken, nil
+	}
+
+	if a.Auth == "" {
+		return a.Username, a.Password, nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(a.Auth)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid auth for %s: %s", server, err)
+	}
+
+	parts := strings.SplitN(string(data), ":", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("invalid auth for %s", server)
+	}
+	return parts[0], parts[1], nil
+}
+
+// helperCreds runs `docker-credential-<helper> get` for a server.
+func helperCreds(helper, server string) (username, password string, err error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	if err != nil {
+		msg := strings.TrimSpace(stdout.String() + stderr.String())
+		if strings.Contains(msg, "credentials not found") {
+			return "", "", errNoCreds
+		}
+		if msg != "" {
+			return "", "", fmt.Errorf("docker-credential-%s: %s", helper, msg)
+		}
+		return "", "", fmt.Errorf("docker-credential-%s: %s", helper, err)
+	}
+
+	var creds struct {
+		Username string
+		Secret   string
+	}
+	err = json.Unmarshal(stdout.Bytes(), &creds)
+	if err != nil {
+		return "", "", fmt.Errorf("docker-credential-%s: %s", helper, err)
+	}
+
+	return creds.Username, creds.Secret, nil
+}
+
+// normalizeRegistry reduces a config key like https://index.docker.io/v1/
+// or http://localhost:5000 to the registry host used in references.
+func normalizeRegistry(key string) string {
+	key = strings.ToLower(key)
+	key = strings.TrimPrefix(key, "https://")
+	key = strings.TrimPrefix(key, "http://")
+	if idx := strings.Index(key, "/"); idx >= 0 {
+		key = key[:idx]
+	}
+
+	switch key {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return "docker.io"
+	}
+	return key
+}
@@ -0,0 +1,212 @@
+package dkrregistry
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// credentialHelper answers with the helper name as username and the server
+// it was asked for as secret, except for servers containing "unknown".
+const credentialHelper = `#!/bin/sh
+read server
+case "$server" in
+*unknown*) echo "credentials not found in native keychain"; exit 1;;
+*broken*) echo "keychain is locked" >&2; exit 1;;
+esac
+printf '{"ServerURL": "%s", "Username": "%s", "Secret": "%s"}' "$server" "${0##*docker-credential-}" "$server"
+`
+
+// withCredentialHelpers puts the docker-credential-* helpers on the PATH
+// until the returned function is called.
+func withCredentialHelpers(t *testing.T, helpers ...string) func() {
+	if runtime.GOOS == "windows" {
+		t.Skip("credential helpers are shell scripts")
+	}
+
+	dir, err := ioutil.TempDir("", "dkr-helpers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, helper := range helpers {
+		err = ioutil.WriteFile(filepath.Join(dir, "docker-credential-"+helper), []byte(credentialHelper), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+
+	return func() {
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestRegistryCreds(t *testing.T) {
+	defer withCredentialHelpers(t, "store", "ecr")()
+
+	basic := func(username, password string) string {
+		return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	}
+
+	tests := []struct {
+		name     string
+		config   string
+		env      map[string]string
+		reg      string
+		username string
+		password string
+		err      string
+	}{
+		{
+			name:     "docker hub key",
+			config:   `{"auths": {"https://index.docker.io/v1/": {"auth": "` + basic("hub", "secret") + `"}}}`,
+			reg:      "docker.io",
+			username: "hub",
+			password: "secret",
+		},
+		{
+			name:     "docker hub alias",
+			config:   `{"auths": {"https://index.docker.io/v1/": {"auth": "` + basic("hub", "secret") + `"}}}`,
+			reg:      "registry-1.docker.io",
+			username: "hub",
+			password: "secret",
+		},
+		{
+			name:     "scheme, path and case",
+			config:   `{"auths": {"http://Registry.Example.com:5000/v2/": {"username": "user", "password": "pass"}}}`,
+			reg:      "registry.example.com:5000",
+			username: "user",
+			password: "pass",
+		},
+		{
+			name:   "other port",
+			config: `{"auths": {"registry.example.com:5000": {"username": "user", "password": "pass"}}}`,
+			reg:    "registry.example.com",
+			err:    errNoCreds.Error(),
+		},
+		{
+			name:   "invalid auth",
+			config: `{"auths": {"registry.example.com": {"auth": "` + basic("user", "")[:3] + `"}}}`,
+			reg:    "registry.example.com",
+			err:    "invalid auth for registry.example.com",
+		},
+		{
+			name:     "credsStore",
+			config:   `{"credsStore": "store", "auths": {"https://index.docker.io/v1/": {}}}`,
+			reg:      "docker.io",
+			username: "store",
+			password: "https://index.docker.io/v1/",
+		},
+		{
+			name:     "credsStore without the registry",
+			config:   `{"credsStore": "store", "auths": {"unknown.example.com": {"username": "user", "password": "pass"}}}`,
+			reg:      "unknown.example.com",
+			username: "user",
+			password: "pass",
+		},
+		{
+			name:     "credHelpers before credsStore",
+			config:   `{"credsStore": "store", "credHelpers": {"https://123.dkr.ecr.example.com": "ecr"}}`,
+			reg:      "123.dkr.ecr.example.com",
+			username: "ecr",
+			password: "123.dkr.ecr.example.com",
+		},
+		{
+			name:   "credHelpers without the registry",
+			config: `{"credHelpers": {"unknown.example.com": "ecr"}, "auths": {"unknown.example.com": {"username": "user", "password": "pass"}}}`,
+			reg:    "unknown.example.com",
+			err:    errNoCreds.Error(),
+		},
+		{
+			name:   "helper error",
+			config: `{"credHelpers": {"broken.example.com": "ecr"}}`,
+			reg:    "broken.example.com",
+			err:    "docker-credential-ecr: keychain is locked",
+		},
+		{
+			name:   "missing helper",
+			config: `{"credHelpers": {"registry.example.com": "missing"}}`,
+			reg:    "registry.example.com",
+			err:    "docker-credential-missing",
+		},
+		{
+			name:     "registry env",
+			config:   `{"auths": {"localhost:5000": {"username": "user", "password": "pass"}}}`,
+			env:      map[string]string{"DKR_LOCALHOST_5000_USERNAME": "env", "DKR_LOCALHOST_5000_PASSWORD": "env-pass", "DKR_USERNAME": "global"},
+			reg:      "localhost:5000",
+			username: "env",
+			password: "env-pass",
+		},
+		{
+			name:     "global env after the docker config",
+			config:   `{"auths": {"registry.example.com": {"username": "user", "password": "pass"}}}`,
+			env:      map[string]string{"DKR_USERNAME": "global", "DKR_PASSWORD": "global-pass"},
+			reg:      "registry.example.com",
+			username: "user",
+			password: "pass",
+		},
+		{
+			name:     "global env",
+			config:   `{"auths": {"registry.example.com": {"username": "user", "password": "pass"}}}`,
+			env:      map[string]string{"DKR_USERNAME": "global", "DKR_PASSWORD": "global-pass"},
+			reg:      "other.example.com",
+			username: "global",
+			password: "global-pass",
+		},
+	}
+
+	for _, test := range tests {
+		func() {
+			defer withoutCreds(t)()
+
+			err := ioutil.WriteFile(filepath.Join(os.Getenv("DOCKER_CONFIG"), "config.json"), []byte(test.config), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for key, value := range test.env {
+				os.Setenv(key, value)
+				defer os.Unsetenv(key)
+			}
+
+			username, password, err := getRegCreds(test.reg)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("%s: %s", test.name, err)
+				return
+			}
+			if username != test.username || password != test.password {
+				t.Errorf("%s: expected %q %q, got %q %q", test.name, test.username, test.password, username, password)
+			}
+		}()
+	}
+}
+
+func TestDockerConfigIdentityToken(t *testing.T) {
+	defer withoutCreds(t)()
+
+	config := `{"auths": {"https://example.azurecr.io": {"identitytoken": "refresh"}}}`
+	err := ioutil.WriteFile(filepath.Join(os.Getenv("DOCKER_CONFIG"), "config.json"), []byte(config), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	username, password, err := getRegCreds("example.azurecr.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != identityTokenUser || password != "refresh" {
+		t.Fatalf("expected the identity token, got %q %q", username, password)
+	}
+}
@@ -0,0 +1,69 @@
+package dkrregistry
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/docker/distribution/digest"
+	"github.com/fd/dkr-util/pkg/archive"
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+// GetBlob downloads a blob into the spool and verifies its digest.
+func GetBlob(hub *registry.Registry, spool *dkrarchive.Spool, repo string, d digest.Digest) (*dkrarchive.Content, error) {
+	body, err := hub.DownloadLayer(repo, d)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	c, err := spool.Copy(body)
+	if err != nil {
+		return nil, err
+	}
+	if c.Digest != d {
+		return nil, fmt.Errorf("blob digest mismatch: expected %s got %s", d, c.Digest)
+	}
+
+	return c, nil
+}
+
+// openBlobRange returns n bytes of a blob starting at off. Registries that
+// ignore the Range header send the whole blob, which is then skipped to
+// off.
+func openBlobRange(hub *registry.Registry, repo string, d digest.Digest, off, n int64) (io.ReadCloser, error) {
+	blobURL := fmt.Sprintf("%s/v2/%s/blobs/%s", strings.TrimSuffix(hub.URL, "/"), repo, d)
+	hub.Logf("registry.blob.get url=%s repository=%s digest=%s range=%d-%d", blobURL, repo, d, off, off+n-1)
+
+	req, err := http.NewRequest("GET", blobURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+n-1))
+
+	resp, err := hub.Client.Do(req)
+	if err != nil {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusPartialContent && off > 0 {
+		_, err = io.CopyN(ioutil.Discard, resp.Body, off)
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+
+	return &limitedReadCloser{io.LimitReader(resp.Body, n), resp.Body}, nil
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,128 @@
+package dkrregistry
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultCertsDir is where docker looks for the certificates of registries.
+const DefaultCertsDir = "/etc/docker/certs.d"
+
+// Config holds the connection settings for registries.
+type Config struct {
+	// Insecure lists the registries that may be reached over plain HTTP or
+	// with a certificate that can't be verified.
+	Insecure []string
+
+	// CertsDir holds a directory per registry host (host:port when the
+	// registry isn't on 443) with CA certificates (*.crt) and client
+	// certificates (*.cert with a matching *.key). Defaults to
+	// DefaultCertsDir.
+	CertsDir string
+
+	// Mirrors maps registry hosts to the endpoints (host[:port], optionally
+	// with an http:// or https:// prefix) that are tried in order before the
+	// registry itself, e.g. "docker.io" to a pull-through cache.
+	Mirrors map[string][]string
+}
+
+// AddMirror adds a mirror in the REGISTRY=ENDPOINT form.
+func (c *Config) AddMirror(s string) error {
+	idx := strings.Index(s, "=")
+	if idx <= 0 || idx == len(s)-1 {
+		return fmt.Errorf("invalid mirror %q (expected REGISTRY=ENDPOINT)", s)
+	}
+
+	if c.Mirrors == nil {
+		c.Mirrors = map[string][]string{}
+	}
+	reg := normalizeRegistry(s[:idx])
+	c.Mirrors[reg] = append(c.Mirrors[reg], s[idx+1:])
+	return nil
+}
+
+// IsInsecure reports whether reg is in the insecure list.
+func (c Config) IsInsecure(reg string) bool {
+	reg = normalizeRegistry(reg)
+	for _, r := range c.Insecure {
+		if normalizeRegistry(r) == reg {
+			return true
+		}
+	}
+	return false
+}
+
+// transport returns the base transport for a registry, with the TLS
+// settings from its certs.d directory.
+func (c Config) transport(reg string) (http.RoundTripper, error) {
+	tlsConfig, err := c.tlsConfig(reg)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+func (c Config) tlsConfig(reg string) (*tls.Config, error) {
+	conf := &tls.Config{InsecureSkipVerify: c.IsInsecure(reg)}
+
+	dir := c.CertsDir
+	if dir == "" {
+		dir = DefaultCertsDir
+	}
+	dir = filepath.Join(dir, reg)
+
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return conf, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		name := filepath.Join(dir, f.Name())
+
+		switch {
+		case strings.HasSuffix(name, ".crt"):
+			if conf.RootCAs == nil {
+				conf.RootCAs, err = x509.SystemCertPool()
+				if err != nil {
+					conf.RootCAs = x509.NewCertPool()
+				}
+			}
+
+			data, err := ioutil.ReadFile(name)
+			if err != nil {
+				return nil, err
+			}
+			if !conf.RootCAs.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("%s: no certificates found", name)
+			}
+
+		case strings.HasSuffix(name, ".cert"):
+			keyName := strings.TrimSuffix(name, ".cert") + ".key"
+			cert, err := tls.LoadX509KeyPair(name, keyName)
+			if err != nil {
+				return nil, err
+			}
+			conf.Certificates = append(conf.Certificates, cert)
+
+		case strings.HasSuffix(name, ".key"):
+			certName := strings.TrimSuffix(name, ".key") + ".cert"
+			if _, err := os.Stat(certName); err != nil {
+				return nil, fmt.Errorf("%s: missing client certificate %s", name, certName)
+			}
+		}
+	}
+
+	return conf, nil
+}
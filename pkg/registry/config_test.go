@@ -0,0 +1,207 @@
+package dkrregistry
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withoutCreds makes the credential lookups find nothing until the returned
+// function is called.
+func withoutCreds(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "dkr-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{}
+	for _, key := range []string{"DOCKER_CONFIG", "DKR_USERNAME", "DKR_PASSWORD"} {
+		env[key] = os.Getenv(key)
+		os.Unsetenv(key)
+	}
+	os.Setenv("DOCKER_CONFIG", dir)
+
+	return func() {
+		for key, value := range env {
+			os.Setenv(key, value)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+// writeCertsDir writes files into the certs.d directory of host.
+func writeCertsDir(t *testing.T, host string, files map[string][]byte) string {
+	dir, err := ioutil.TempDir("", "dkr-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.MkdirAll(filepath.Join(dir, host), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, host, name), data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+func certPEM(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+// clientCert returns a self-signed client certificate and its key.
+func clientCert(t *testing.T) (*x509.Certificate, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dkr"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func serverHost(srv *httptest.Server) string {
+	return strings.TrimPrefix(strings.TrimPrefix(srv.URL, "https://"), "http://")
+}
+
+func TestDialCertsDirCA(t *testing.T) {
+	defer withoutCreds(t)()
+
+	srv := httptest.NewTLSServer(newFakeRegistry())
+	defer srv.Close()
+	host := serverHost(srv)
+
+	otherDir := writeCertsDir(t, "other", nil)
+	defer os.RemoveAll(otherDir)
+
+	_, err := dialEndpoint(host, Config{CertsDir: otherDir})
+	if err == nil {
+		t.Fatal("expected an untrusted certificate to be rejected")
+	}
+
+	certsDir := writeCertsDir(t, host, map[string][]byte{"ca.crt": certPEM(srv.Certificate())})
+	defer os.RemoveAll(certsDir)
+
+	hub, err := dialEndpoint(host, Config{CertsDir: certsDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hub.URL != "https://"+host {
+		t.Fatalf("expected https://%s, got %s", host, hub.URL)
+	}
+}
+
+func TestDialCertsDirClientCert(t *testing.T) {
+	defer withoutCreds(t)()
+
+	cert, key := clientCert(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+
+	srv := httptest.NewUnstartedServer(newFakeRegistry())
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	srv.StartTLS()
+	defer srv.Close()
+	host := serverHost(srv)
+
+	certsDir := writeCertsDir(t, host, map[string][]byte{"ca.crt": certPEM(srv.Certificate())})
+	defer os.RemoveAll(certsDir)
+
+	_, err := dialEndpoint(host, Config{CertsDir: certsDir})
+	if err == nil {
+		t.Fatal("expected the registry to require a client certificate")
+	}
+
+	err = ioutil.WriteFile(filepath.Join(certsDir, host, "client.cert"), certPEM(cert), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dialEndpoint(host, Config{CertsDir: certsDir})
+	if err == nil || !strings.Contains(err.Error(), "client.key") {
+		t.Fatalf("expected the missing key to be reported, got %v", err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(certsDir, host, "client.key"), key, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dialEndpoint(host, Config{CertsDir: certsDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDialInsecure(t *testing.T) {
+	defer withoutCreds(t)()
+
+	certsDir := writeCertsDir(t, "other", nil)
+	defer os.RemoveAll(certsDir)
+
+	plain := httptest.NewServer(newFakeRegistry())
+	defer plain.Close()
+	host := serverHost(plain)
+
+	_, err := dialEndpoint(host, Config{CertsDir: certsDir})
+	if err == nil {
+		t.Fatal("expected a secure registry not to fall back to HTTP")
+	}
+
+	hub, err := dialEndpoint(host, Config{CertsDir: certsDir, Insecure: []string{host}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hub.URL != "http://"+host {
+		t.Fatalf("expected http://%s, got %s", host, hub.URL)
+	}
+
+	secure := httptest.NewTLSServer(newFakeRegistry())
+	defer secure.Close()
+	host = serverHost(secure)
+
+	hub, err = dialEndpoint(host, Config{CertsDir: certsDir, Insecure: []string{host}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hub.URL != "https://"+host {
+		t.Fatalf("expected https://%s, got %s", host, hub.URL)
+	}
+}
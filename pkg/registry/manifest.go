@@ -0,0 +1,159 @@
+package dkrregistry
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/docker/distribution/digest"
+	"github.com/fd/dkr-util/pkg/archive"
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+// manifestMediaTypes are the manifest formats requested from registries.
+var manifestMediaTypes = []string{
+	dkrarchive.MediaTypeManifestV2,
+	dkrarchive.MediaTypeOCIManifest,
+	dkrarchive.MediaTypeManifestV1Sig,
+	dkrarchive.MediaTypeManifestV1,
+}
+
+// allMediaTypes returns the manifest formats including manifest lists and
+// image indexes.
+func allMediaTypes() []string {
+	return append([]string{dkrarchive.MediaTypeManifestList, dkrarchive.MediaTypeOCIIndex}, manifestMediaTypes...)
+}
+
+func manifestURL(hub *registry.Registry, repo, reference string) string {
+	return fmt.Sprintf("%s/v2/%s/manifests/%s", strings.TrimSuffix(hub.URL, "/"), repo, reference)
+}
+
+// GetManifest fetches a manifest by tag or digest and returns its media type
+// and raw content. Manifests fetched by digest are verified.
+func GetManifest(hub *registry.Registry, repo, reference string) (string, []byte, error) {
+	return getManifest(hub, repo, reference, manifestMediaTypes)
+}
+
+// GetManifestOrIndex is like GetManifest, but also accepts manifest lists
+// and OCI image indexes.
+func GetManifestOrIndex(hub *registry.Registry, repo, reference string) (string, []byte, error) {
+	return getManifest(hub, repo, reference, allMediaTypes())
+}
+
+func getManifest(hub *registry.Registry, repo, reference string, accept []string) (string, []byte, error) {
+	url := manifestURL(hub, repo, reference)
+	hub.Logf("registry.manifest.get url=%s repository=%s reference=%s", url, repo, reference)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", nil, err
+	}
+
+	req.Header.Set("Accept", strings.Join(accept, ", "))
+	resp, err := hub.Client.Do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if d, err := digest.ParseDigest(reference); err == nil {
+		actual, err := digest.FromBytes(data)
+		if err != nil {
+			return "", nil, err
+		}
+		if actual != d {
+			return "", nil, fmt.Errorf("manifest digest mismatch: expected %s got %s", d, actual)
+		}
+	}
+
+	mediaType := resp.Header.Get("Content-Type")
+	if idx := strings.Index(mediaType, ";"); idx >= 0 {
+		mediaType = mediaType[:idx]
+	}
+
+	return mediaType, data, nil
+}
+
+// PutManifest uploads a manifest under a tag or digest and returns the
+// digest the registry assigned to it.
+func PutManifest(hub *registry.Registry, repo, reference, mediaType string, data []byte) (digest.Digest, error) {
+	url := manifestURL(hub, repo, reference)
+	hub.Logf("registry.manifest.put url=%s repository=%s reference=%s", url, repo, reference)
+
+	req, err := http.NewRequest("PUT", url, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", mediaType)
+	resp, err := hub.Client.Do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if d, err := digest.ParseDigest(resp.Header.Get("Docker-Content-Digest")); err == nil {
+		return d, nil
+	}
+	return digest.FromBytes(data)
+}
+
+// ManifestDigest returns the digest of the manifest a tag points to, as
+// reported by the registry.
+func ManifestDigest(hub *registry.Registry, repo, reference string) (digest.Digest, error) {
+	url := manifestURL(hub, repo, reference)
+	hub.Logf("registry.manifest.head url=%s repository=%s reference=%s", url, repo, reference)
+
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Accept", strings.Join(allMediaTypes(), ", "))
+	resp, err := hub.Client.Do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if d, err := digest.ParseDigest(resp.Header.Get("Docker-Content-Digest")); err == nil {
+		return d, nil
+	}
+
+	_, data, err := GetManifestOrIndex(hub, repo, reference)
+	if err != nil {
+		return "", err
+	}
+	return digest.FromBytes(data)
+}
+
+// DeleteManifest deletes a manifest by digest. This removes every tag that
+// points to it.
+func DeleteManifest(hub *registry.Registry, repo string, d digest.Digest) error {
+	url := manifestURL(hub, repo, d.String())
+	hub.Logf("registry.manifest.delete url=%s repository=%s reference=%s", url, repo, d)
+
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := hub.Client.Do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	return err
+}
@@ -0,0 +1,138 @@
+package dkrregistry
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+// mirrorTransport sends the requests for a registry to the first of its
+// endpoints (mirrors, then the registry itself) and falls back to the next
+// one when an endpoint can't be reached or fails a request with a server
+// error, like a pull-through cache that can't reach its upstream. When all
+// endpoints fail, the failure of the first one is returned.
+type mirrorTransport struct {
+	conf      Config
+	endpoints []*mirrorEndpoint
+}
+
+// mirrorEndpoint is dialed the first time a request falls back to it.
+type mirrorEndpoint struct {
+	name string
+
+	mu     sync.Mutex
+	dialed bool
+	hub    *registry.Registry
+	err    error
+}
+
+func (e *mirrorEndpoint) dial(conf Config) (*registry.Registry, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.dialed {
+		e.hub, e.err = dialEndpoint(e.name, conf)
+		e.dialed = true
+	}
+	return e.hub, e.err
+}
+
+// dialedHub returns the hub of the endpoint, or nil when it hasn't been
+// dialed successfully.
+func (e *mirrorEndpoint) dialedHub() *registry.Registry {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.err != nil {
+		return nil
+	}
+	return e.hub
+}
+
+func (t *mirrorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	first := t.endpointFor(req)
+	if first < 0 {
+		// redirects to the storage backend of an endpoint
+		return t.endpoints[0].dialedHub().Client.Transport.RoundTrip(req)
+	}
+
+	resp, err := t.endpoints[first].hub.Client.Transport.RoundTrip(req)
+	if !shouldFallback(err) || req.Body != nil && req.GetBody == nil {
+		return resp, err
+	}
+
+	for _, e := range t.endpoints[first+1:] {
+		hub, dialErr := e.dial(t.conf)
+		if dialErr != nil {
+			continue
+		}
+
+		r, rewriteErr := rewriteRequest(req, hub.URL)
+		if rewriteErr != nil {
+			break
+		}
+
+		fallbackResp, fallbackErr := hub.Client.Transport.RoundTrip(r)
+		if shouldFallback(fallbackErr) {
+			continue
+		}
+
+		// later requests of an upload must go to the same endpoint
+		if fallbackResp != nil {
+			if loc, err := fallbackResp.Location(); err == nil {
+				fallbackResp.Header.Set("Location", loc.String())
+			}
+		}
+		return fallbackResp, fallbackErr
+	}
+
+	return resp, err
+}
+
+// endpointFor returns the index of the dialed endpoint a request is for,
+// or -1 when it is for another host.
+func (t *mirrorTransport) endpointFor(req *http.Request) int {
+	for i, e := range t.endpoints {
+		hub := e.dialedHub()
+		if hub == nil {
+			continue
+		}
+		if u, err := url.Parse(hub.URL); err == nil && u.Host == req.URL.Host {
+			return i
+		}
+	}
+	return -1
+}
+
+// shouldFallback reports whether a request that failed with err may
+// succeed at another endpoint: when the endpoint can't be reached or fails
+// with a server error. Any other response, like a 404 for a blob, is the
+// answer, so the requests of one operation all see the same endpoint.
+func shouldFallback(err error) bool {
+	if err == nil {
+		return false
+	}
+	status := httpStatus(err)
+	return status == 0 || status >= 500
+}
+
+// rewriteRequest returns a copy of req for the registry at regURL.
+func rewriteRequest(req *http.Request, regURL string) (*http.Request, error) {
+	base, err := url.Parse(regURL)
+	if err != nil {
+		return nil, err
+	}
+
+	r := cloneRequest(req)
+	u := *req.URL
+	u.Scheme, u.Host = base.Scheme, base.Host
+	r.URL, r.Host = &u, ""
+
+	if req.Body != nil {
+		r.Body, err = req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
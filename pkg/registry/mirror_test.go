@@ -0,0 +1,135 @@
+package dkrregistry
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+	"github.com/fd/dkr-util/pkg/archive"
+)
+
+// testMirror returns a config that mirrors a registry that is only reachable
+// over plain HTTP.
+func testMirror(mirror, reg *httptest.Server) (string, Config) {
+	regHost := serverHost(reg)
+	return regHost, Config{
+		Insecure: []string{regHost},
+		Mirrors:  map[string][]string{regHost: {mirror.URL}},
+	}
+}
+
+func TestMirrorFallsBackToRegistry(t *testing.T) {
+	defer withoutCreds(t)()
+
+	d, _ := digest.FromBytes([]byte("layer"))
+	cache := newFakeRegistry()
+	cache.unavailable = true
+	upstream := newFakeRegistry()
+	upstream.blobs["app@"+d.String()] = []byte("layer")
+
+	mirror := httptest.NewServer(cache)
+	defer mirror.Close()
+	reg := httptest.NewServer(upstream)
+	defer reg.Close()
+
+	regHost, conf := testMirror(mirror, reg)
+	hub, err := Dial(regHost, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hub.URL != mirror.URL {
+		t.Fatalf("expected the mirror %s to be used, got %s", mirror.URL, hub.URL)
+	}
+
+	spool, err := dkrarchive.NewSpool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	c, err := GetBlob(hub, spool, "app", d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Digest != d {
+		t.Fatalf("expected %s, got %s", d, c.Digest)
+	}
+}
+
+func TestMirrorFallsBackForUploads(t *testing.T) {
+	defer withoutCreds(t)()
+
+	cache := newFakeRegistry()
+	cache.unavailable = true
+	upstream := newFakeRegistry()
+
+	mirror := httptest.NewServer(cache)
+	defer mirror.Close()
+	reg := httptest.NewServer(upstream)
+	defer reg.Close()
+
+	regHost, conf := testMirror(mirror, reg)
+	hub, err := Dial(regHost, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := dkrarchive.Bytes([]byte("0123456789"))
+	err = UploadBlob(hub, "app", content.Digest, content, testUploadOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(upstream.blobs["app@"+content.Digest.String()]) != "0123456789" {
+		t.Fatal("expected the blob to be uploaded to the registry")
+	}
+	if cache.requests != 1 || len(upstream.patches) != 3 {
+		t.Fatalf("expected only the first request to go to the mirror, got %d", cache.requests)
+	}
+}
+
+func TestMirrorNotFound(t *testing.T) {
+	defer withoutCreds(t)()
+
+	d, _ := digest.FromBytes([]byte("layer"))
+	cache := newFakeRegistry()
+	upstream := newFakeRegistry()
+	upstream.blobs["app@"+d.String()] = []byte("layer")
+
+	mirror := httptest.NewServer(cache)
+	defer mirror.Close()
+	reg := httptest.NewServer(upstream)
+	defer reg.Close()
+
+	regHost, conf := testMirror(mirror, reg)
+	hub, err := Dial(regHost, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := hub.HasLayer("app", d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok || cache.requests != 1 || upstream.requests != 0 {
+		t.Fatalf("expected the 404 of the mirror to be the answer, got %v after %d requests to the registry", ok, upstream.requests)
+	}
+}
+
+func TestMirrorUnreachable(t *testing.T) {
+	defer withoutCreds(t)()
+
+	mirror := httptest.NewServer(newFakeRegistry())
+	mirror.Close()
+	reg := httptest.NewServer(newFakeRegistry())
+	defer reg.Close()
+
+	regHost, conf := testMirror(mirror, reg)
+	hub, err := Dial(regHost, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hub.URL != reg.URL {
+		t.Fatalf("expected the registry %s to be used, got %s", reg.URL, hub.URL)
+	}
+}
@@ -0,0 +1,74 @@
+package dkrregistry
+
+import (
+	"strings"
+)
+
+// Ref is a reference to an image in a registry.
+type Ref struct {
+	Registry string
+	Repo     string
+	Tag      string
+	Digest   string
+}
+
+// ParseRef parses an image reference like `gcr.io/proj/app:v1`,
+// `app@sha256:...` or `user/app`. Names without a registry are on docker.io
+// and single component names on docker.io are in the library namespace.
+// References without a tag or digest get the latest tag.
+func ParseRef(s string) Ref {
+	var r Ref
+
+	if idx := strings.Index(s, "@"); idx >= 0 {
+		s, r.Digest = s[:idx], s[idx+1:]
+	}
+
+	if idx := strings.LastIndex(s, ":"); idx > strings.LastIndex(s, "/") {
+		s, r.Tag = s[:idx], s[idx+1:]
+	}
+	if r.Tag == "" && r.Digest == "" {
+		r.Tag = "latest"
+	}
+
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		r.Registry, r.Repo = parts[0], parts[1]
+	} else {
+		r.Registry, r.Repo = "docker.io", s
+	}
+
+	if r.Registry == "docker.io" && !strings.Contains(r.Repo, "/") {
+		r.Repo = "library/" + r.Repo
+	}
+
+	return r
+}
+
+// Name returns the normalized repository name, without tag or digest.
+func (r Ref) Name() string {
+	if r.Registry == "docker.io" {
+		return strings.TrimPrefix(r.Repo, "library/")
+	}
+	return r.Registry + "/" + r.Repo
+}
+
+// Reference returns the digest or else the tag of the reference, as used in
+// manifest URLs.
+func (r Ref) Reference() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+// String returns the normalized reference.
+func (r Ref) String() string {
+	s := r.Name()
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
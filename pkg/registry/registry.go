@@ -0,0 +1,182 @@
+package dkrregistry
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
+
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+// Dial connects to a registry using the credentials available for it.
+// Registries without credentials are used anonymously. Insecure registries
+// fall back to plain HTTP when they can't be reached over HTTPS. When the
+// registry has mirrors they are tried in order before the registry itself:
+// requests go to the first endpoint that can be reached and fall back to
+// the next ones when they fail there.
+func Dial(reg string, conf Config) (*registry.Registry, error) {
+	mirrors := conf.Mirrors[normalizeRegistry(reg)]
+	if len(mirrors) == 0 {
+		return dialEndpoint(reg, conf)
+	}
+
+	var endpoints []*mirrorEndpoint
+	for _, mirror := range mirrors {
+		endpoints = append(endpoints, &mirrorEndpoint{name: mirror})
+	}
+	endpoints = append(endpoints, &mirrorEndpoint{name: reg})
+
+	var errs []string
+	for i, e := range endpoints {
+		hub, err := e.dial(conf)
+		if err == nil {
+			return &registry.Registry{
+				URL:  hub.URL,
+				Logf: hub.Logf,
+				Client: &http.Client{
+					Transport: &mirrorTransport{conf: conf, endpoints: endpoints[i:]},
+				},
+			}, nil
+		}
+
+		if i < len(mirrors) {
+			errs = append(errs, fmt.Sprintf("mirror %s: %s", e.name, err))
+		} else {
+			errs = append(errs, fmt.Sprintf("%s: %s", reg, err))
+		}
+	}
+	return nil, errors.New(strings.Join(errs, "; "))
+}
+
+// dialEndpoint connects to a registry host. An http:// or https:// prefix
+// forces the scheme.
+func dialEndpoint(endpoint string, conf Config) (*registry.Registry, error) {
+	reg := normalizeRegistry(endpoint)
+
+	username, password, err := getRegCreds(reg)
+	if err == errNoCreds {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := conf.transport(reg)
+	if err != nil {
+		return nil, err
+	}
+
+	regURL := registryNameToURL(reg)
+	if strings.HasPrefix(endpoint, "http://") {
+		regURL = "http://" + reg
+	}
+
+	hub := newHub(regURL, transport, username, password)
+	err = hub.Ping()
+	if err != nil && conf.IsInsecure(reg) && httpStatus(err) == 0 && !strings.HasPrefix(regURL, "http://") {
+		plain := newHub("http://"+reg, transport, username, password)
+		if plain.Ping() == nil {
+			return plain, nil
+		}
+	}
+	if httpStatus(err) == http.StatusUnauthorized && username == "" && password == "" {
+		return nil, fmt.Errorf("not logged in to %s", reg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return hub, nil
+}
+
+func newHub(regURL string, transport http.RoundTripper, username, password string) *registry.Registry {
+	return &registry.Registry{
+		URL:  regURL,
+		Logf: registry.Quiet,
+		// Logf: registry.Log,
+		Client: &http.Client{
+			Transport: wrapTransport(transport, regURL, username, password),
+		},
+	}
+}
+
+func registryNameToURL(name string) string {
+	if name == "docker.io" {
+		return "https://index.docker.io"
+	}
+	return "https://" + name
+}
+
+// getRegCreds looks up the credentials for a registry host in the
+// environment, then in the docker config and finally, for gcr.io, in the
+// Google application default credentials. It returns errNoCreds when none
+// are found.
+func getRegCreds(reg string) (username, password string, err error) {
+	reg = normalizeRegistry(reg)
+
+	username, password, err = envCreds("DKR_" + envName(reg) + "_")
+	if err != errNoCreds {
+		return username, password, err
+	}
+
+	username, password, err = dockerConfigCreds(reg)
+	if err != errNoCreds {
+		return username, password, err
+	}
+
+	// DKR_USERNAME comes after the credentials for this registry, so the
+	// other registries of a push keep their own
+	username, password, err = envCreds("DKR_")
+	if err != errNoCreds {
+		return username, password, err
+	}
+
+	if strings.Contains(reg, "gcr.io") {
+		ts, err := google.DefaultTokenSource(context.Background())
+		if err != nil {
+			return "", "", err
+		}
+
+		token, err := ts.Token()
+		if err != nil {
+			return "", "", err
+		}
+
+		return "_token", token.AccessToken, nil
+	}
+
+	return "", "", errNoCreds
+}
+
+func wrapTransport(transport http.RoundTripper, regURL, username, password string) http.RoundTripper {
+	var host string
+	if u, err := url.Parse(regURL); err == nil {
+		host = u.Host
+	}
+
+	tokenTransport := &tokenTransport{
+		Transport: transport,
+		Host:      host,
+		Username:  username,
+		Password:  password,
+	}
+	basicAuthTransport := &registry.BasicTransport{
+		Transport: tokenTransport,
+		URL:       regURL,
+		Username:  username,
+		Password:  password,
+	}
+	if username == identityTokenUser {
+		// identity tokens are only sent to the token service
+		basicAuthTransport.Username, basicAuthTransport.Password = "", ""
+	}
+	errorTransport := &registry.ErrorTransport{
+		Transport: basicAuthTransport,
+	}
+	return errorTransport
+}
@@ -0,0 +1,185 @@
+package dkrregistry
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/docker/distribution/digest"
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+// fakeRegistry implements the blob upload API of a registry, with knobs to
+// make it fail the ways real registries do.
+type fakeRegistry struct {
+	mu       sync.Mutex
+	blobs    map[string][]byte // repo@digest
+	sessions map[string][]byte
+	repos    map[string]string // session -> repo
+	next     int
+
+	// failPatches fails that many PATCH requests with a 500 after storing
+	// storeOnFail bytes of them.
+	failPatches int
+	storeOnFail int
+
+	// dropSessions answers that many status requests with a 404 and forgets
+	// the session.
+	dropSessions int
+
+	// emptyRange reports an empty session as 0-0 instead of leaving out
+	// the Range header, like distribution.
+	emptyRange bool
+
+	// mount makes the registry mount blobs from other repositories.
+	mount bool
+
+	// unavailable fails every request but the ping with a 503, like a
+	// pull-through cache that can't reach its upstream.
+	unavailable bool
+
+	requests  int      // requests but the ping
+	patches   []string // Content-Range of every PATCH
+	initiated int
+	canceled  []string
+	uploads   int // requests to the upload API
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{
+		blobs:    map[string][]byte{},
+		sessions: map[string][]byte{},
+		repos:    map[string]string{},
+	}
+}
+
+// serve starts the registry and returns a hub that talks to it.
+func (f *fakeRegistry) serve() (*registry.Registry, *httptest.Server) {
+	srv := httptest.NewServer(f)
+	return newHub(srv.URL, http.DefaultTransport, "", ""), srv
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p := strings.TrimPrefix(r.URL.Path, "/v2/")
+	if p == "" {
+		return
+	}
+
+	f.requests++
+	if f.unavailable {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	if i := strings.Index(p, "/blobs/uploads/"); i >= 0 {
+		f.serveUpload(w, r, p[:i], p[i+len("/blobs/uploads/"):])
+		return
+	}
+
+	if i := strings.Index(p, "/blobs/"); i >= 0 && (r.Method == "HEAD" || r.Method == "GET") {
+		data, ok := f.blobs[p[:i]+"@"+p[i+len("/blobs/"):]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+		return
+	}
+
+	w.WriteHeader(http.StatusNotFound)
+}
+
+func (f *fakeRegistry) serveUpload(w http.ResponseWriter, r *http.Request, repo, id string) {
+	f.uploads++
+
+	if id == "" && r.Method == "POST" {
+		mount, from := r.URL.Query().Get("mount"), r.URL.Query().Get("from")
+		if data, ok := f.blobs[from+"@"+mount]; ok && f.mount {
+			f.blobs[repo+"@"+mount] = data
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+
+		f.next++
+		f.initiated++
+		id = fmt.Sprint(f.next)
+		f.sessions[id] = []byte{}
+		f.repos[id] = repo
+		w.Header().Set("Location", "/v2/"+repo+"/blobs/uploads/"+id)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	data, ok := f.sessions[id]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		if f.dropSessions > 0 {
+			f.dropSessions--
+			delete(f.sessions, id)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		f.writeRange(w, data)
+		w.WriteHeader(http.StatusNoContent)
+
+	case "PATCH":
+		rng := r.Header.Get("Content-Range")
+		f.patches = append(f.patches, rng)
+
+		body, _ := ioutil.ReadAll(r.Body)
+		if !strings.HasPrefix(rng, fmt.Sprintf("%d-", len(data))) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+
+		if f.failPatches > 0 {
+			f.failPatches--
+			f.sessions[id] = append(data, body[:f.storeOnFail]...)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		f.sessions[id] = append(data, body...)
+		w.Header().Set("Location", r.URL.Path)
+		f.writeRange(w, f.sessions[id])
+		w.WriteHeader(http.StatusAccepted)
+
+	case "PUT":
+		d := r.URL.Query().Get("digest")
+		if sum, _ := digest.FromBytes(data); sum.String() != d {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		delete(f.sessions, id)
+		f.blobs[repo+"@"+d] = data
+		w.WriteHeader(http.StatusCreated)
+
+	case "DELETE":
+		delete(f.sessions, id)
+		f.canceled = append(f.canceled, id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeRegistry) writeRange(w http.ResponseWriter, data []byte) {
+	switch {
+	case len(data) > 0:
+		w.Header().Set("Range", fmt.Sprintf("0-%d", len(data)-1))
+	case f.emptyRange:
+		w.Header().Set("Range", "0-0")
+	}
+}
@@ -0,0 +1,69 @@
+package dkrregistry
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+// ListTags returns all tags of a repository. Unlike registry.Tags it follows
+// the Link headers of registries that return the tags in pages.
+func ListTags(hub *registry.Registry, repo string) ([]string, error) {
+	next, err := url.Parse(fmt.Sprintf("%s/v2/%s/tags/list", strings.TrimSuffix(hub.URL, "/"), repo))
+	if err != nil {
+		return nil, err
+	}
+
+	var tags []string
+	for next != nil {
+		hub.Logf("registry.tags url=%s repository=%s", next, repo)
+
+		resp, err := hub.Client.Get(next.String())
+		if err != nil {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return nil, err
+		}
+
+		var page struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, page.Tags...)
+
+		next, err = nextLink(next, resp.Header.Get("Link"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return tags, nil
+}
+
+// nextLink returns the target of a `Link: <url>; rel="next"` header, or nil
+// on the last page.
+func nextLink(current *url.URL, link string) (*url.URL, error) {
+	for _, l := range strings.Split(link, ",") {
+		parts := strings.Split(l, ";")
+		target := strings.TrimSpace(parts[0])
+		if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+			continue
+		}
+
+		for _, param := range parts[1:] {
+			param = strings.Replace(strings.TrimSpace(param), " ", "", -1)
+			if param == `rel="next"` || param == "rel=next" {
+				return current.Parse(target[1 : len(target)-1])
+			}
+		}
+	}
+	return nil, nil
+}
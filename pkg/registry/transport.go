@@ -0,0 +1,277 @@
+package dkrregistry
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// tokenTransport authenticates requests to a registry with bearer tokens.
+// Unlike registry.TokenTransport it doesn't buffer request bodies: tokens
+// are cached and sent up front, and bodies are replayed with GetBody when
+// the registry asks for a new token. Tokens are kept per repository and
+// access, and only sent to the registry host itself, never to the storage
+// backends blob requests are redirected to.
+type tokenTransport struct {
+	Transport http.RoundTripper
+	Host      string
+	Username  string
+	Password  string
+
+	mu     sync.Mutex
+	tokens map[string]string
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != t.Host {
+		return t.Transport.RoundTrip(req)
+	}
+
+	key := tokenKey(req)
+
+	resp, err := t.Transport.RoundTrip(t.authorize(req, t.cachedToken(key)))
+	if err != nil {
+		return resp, err
+	}
+
+	challenge := bearerChallenge(resp)
+	if challenge == nil {
+		return resp, nil
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+
+	resp.Body.Close()
+
+	token, authResp, err := t.auth(challenge)
+	if err != nil || authResp != nil {
+		return authResp, err
+	}
+	t.cacheToken(key, token)
+
+	if req.Body != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		req = cloneRequest(req)
+		req.Body = body
+	}
+
+	return t.Transport.RoundTrip(t.authorize(req, token))
+}
+
+func (t *tokenTransport) cachedToken(key string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.tokens[key]
+}
+
+func (t *tokenTransport) cacheToken(key, token string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.tokens == nil {
+		t.tokens = map[string]string{}
+	}
+	t.tokens[key] = token
+}
+
+// tokenKey returns the key of the cached token for a request: the
+// repository of the request and whether it pulls or pushes. Blob mounts
+// also need access to the repository they mount from.
+func tokenKey(req *http.Request) string {
+	access := "pull"
+	if req.Method != "GET" && req.Method != "HEAD" {
+		access = "push"
+	}
+
+	var repo string
+	p := strings.TrimPrefix(req.URL.Path, "/v2/")
+	for _, sep := range []string{"/manifests/", "/blobs/", "/tags/"} {
+		if i := strings.LastIndex(p, sep); i >= 0 {
+			repo = p[:i]
+			break
+		}
+	}
+
+	key := repo + " " + access
+	if from := req.URL.Query().Get("from"); from != "" {
+		key += " from " + from
+	}
+	return key
+}
+
+// authorize returns a copy of req that carries the token.
+func (t *tokenTransport) authorize(req *http.Request, token string) *http.Request {
+	if token == "" {
+		return req
+	}
+	req = cloneRequest(req)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+// auth requests a token for the challenge. When the token service refuses,
+// its response is returned instead.
+func (t *tokenTransport) auth(challenge map[string]string) (string, *http.Response, error) {
+	var (
+		req *http.Request
+		err error
+	)
+	if t.Username == identityTokenUser {
+		req, err = refreshTokenRequest(challenge, t.Password)
+	} else {
+		req, err = t.tokenRequest(challenge)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	resp, err := t.Transport.RoundTrip(req)
+	if err != nil {
+		return "", nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", resp, nil
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	err = json.Unmarshal(data, &body)
+	if err != nil {
+		return "", nil, err
+	}
+	if body.Token == "" {
+		body.Token = body.AccessToken
+	}
+
+	return body.Token, nil, nil
+}
+
+// tokenRequest asks the token service for a token with the username and
+// password, or anonymously.
+func (t *tokenTransport) tokenRequest(challenge map[string]string) (*http.Request, error) {
+	realm, err := url.Parse(challenge["realm"])
+	if err != nil {
+		return nil, err
+	}
+
+	q := realm.Query()
+	for _, key := range []string{"service", "scope"} {
+		if challenge[key] != "" {
+			q.Set(key, challenge[key])
+		}
+	}
+	realm.RawQuery = q.Encode()
+
+	req, err := http.NewRequest("GET", realm.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if t.Username != "" || t.Password != "" {
+		req.SetBasicAuth(t.Username, t.Password)
+	}
+	return req, nil
+}
+
+// refreshTokenRequest exchanges an identity token for an access token with
+// the OAuth2 refresh token grant, like docker does.
+func refreshTokenRequest(challenge map[string]string, identityToken string) (*http.Request, error) {
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {identityToken},
+		"client_id":     {"dkr"},
+	}
+	for _, key := range []string{"service", "scope"} {
+		if challenge[key] != "" {
+			form.Set(key, challenge[key])
+		}
+	}
+
+	req, err := http.NewRequest("POST", challenge["realm"], strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
+
+func cloneRequest(req *http.Request) *http.Request {
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		r.Header[k] = append([]string(nil), v...)
+	}
+	return r
+}
+
+// bearerChallenge returns the parameters of the bearer challenge of an
+// unauthorized response.
+func bearerChallenge(resp *http.Response) map[string]string {
+	if resp.StatusCode != http.StatusUnauthorized {
+		return nil
+	}
+
+	for _, h := range resp.Header[http.CanonicalHeaderKey("WWW-Authenticate")] {
+		idx := strings.IndexAny(h, " \t")
+		if idx < 0 || !strings.EqualFold(h[:idx], "bearer") {
+			continue
+		}
+		return parseChallengeParams(h[idx+1:])
+	}
+
+	return nil
+}
+
+// parseChallengeParams parses a comma separated list of key=value and
+// key="quoted value" pairs.
+func parseChallengeParams(s string) map[string]string {
+	params := map[string]string{}
+
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			return params
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " \t")
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			var b []byte
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b = append(b, s[i])
+			}
+			if i < len(s) {
+				i++
+			}
+			value, s = string(b), s[i:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			value, s = strings.TrimSpace(s[:end]), s[end:]
+		}
+
+		params[key] = value
+	}
+}
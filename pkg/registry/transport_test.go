@@ -0,0 +1,114 @@
+package dkrregistry
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestTransportIgnoresForeignHosts(t *testing.T) {
+	var storageAuth []string
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		storageAuth = append(storageAuth, r.Header.Get("Authorization"))
+		w.Write([]byte("layer"))
+	}))
+	defer storage.Close()
+
+	var (
+		srv      *httptest.Server
+		fetched  int
+		reqCount int
+	)
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			fetched++
+			w.Write([]byte(`{"token":"secret"}`))
+			return
+		}
+
+		reqCount++
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+srv.URL+`/token",service="test",scope="repository:app:pull"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		// the same path on the storage host gets the same token key
+		http.Redirect(w, r, storage.URL+r.URL.Path, http.StatusTemporaryRedirect)
+	}))
+	defer srv.Close()
+
+	hub := newHub(srv.URL, http.DefaultTransport, "", "")
+	for i := 0; i < 2; i++ {
+		body, err := hub.DownloadLayer("app", "sha256:0000000000000000000000000000000000000000000000000000000000000000")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(body)
+		body.Close()
+		if string(data) != "layer" {
+			t.Fatalf("expected layer, got %q", data)
+		}
+	}
+
+	if fetched != 1 || reqCount != 3 {
+		t.Fatalf("expected the token to be fetched once and reused, fetched %d times in %d requests", fetched, reqCount)
+	}
+	for _, auth := range storageAuth {
+		if auth != "" {
+			t.Fatalf("expected no credentials at the storage backend, got %q", auth)
+		}
+	}
+}
+
+func TestTransportIdentityToken(t *testing.T) {
+	var (
+		srv      *httptest.Server
+		form     url.Values
+		basicReg bool
+	)
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			if r.Method != "POST" {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			r.ParseForm()
+			form = r.PostForm
+			w.Write([]byte(`{"access_token":"secret","refresh_token":"refresh"}`))
+			return
+		}
+
+		if _, _, ok := r.BasicAuth(); ok {
+			basicReg = true
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+srv.URL+`/token",service="test",scope="repository:app:pull"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}))
+	defer srv.Close()
+
+	hub := newHub(srv.URL, http.DefaultTransport, identityTokenUser, "refresh")
+	err := hub.Ping()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {"refresh"},
+		"client_id":     {"dkr"},
+		"service":       {"test"},
+		"scope":         {"repository:app:pull"},
+	}
+	if !reflect.DeepEqual(form, expected) {
+		t.Fatalf("expected %v, got %v", expected, form)
+	}
+	if basicReg {
+		t.Fatal("expected the identity token not to be sent to the registry")
+	}
+}
@@ -0,0 +1,370 @@
+package dkrregistry
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/digest"
+	"github.com/fd/dkr-util/pkg/archive"
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+// UploadOptions control blob uploads. Zero values use the defaults.
+type UploadOptions struct {
+	// ChunkSize is the size of the PATCH requests. Defaults to 8MiB.
+	ChunkSize int64
+	// Retries is the number of times a failed request is retried before the
+	// upload is given up. Defaults to 5. Every uploaded chunk resets the
+	// count.
+	Retries int
+	// Backoff is the delay before the first retry. It doubles with every
+	// retry, up to 30 seconds. Defaults to 1s.
+	Backoff time.Duration
+}
+
+const (
+	defaultChunkSize = 8 << 20
+	defaultRetries   = 5
+	defaultBackoff   = time.Second
+	maxBackoff       = 30 * time.Second
+)
+
+type blobUpload struct {
+	hub    *registry.Registry
+	repo   string
+	digest digest.Digest
+	size   int64
+	open   func(off, n int64) (io.ReadCloser, error)
+	opts   UploadOptions
+}
+
+// UploadBlob uploads a blob with the chunked upload protocol. Failed
+// requests are retried with backoff; after a failure the upload resumes
+// from the offset the registry reports for the upload session.
+func UploadBlob(hub *registry.Registry, repo string, d digest.Digest, content *dkrarchive.Content, opts UploadOptions) error {
+	open := func(off, n int64) (io.ReadCloser, error) {
+		return content.OpenRange(off, n)
+	}
+	return uploadBlob(hub, repo, d, content.Size, open, opts)
+}
+
+// CopyBlob uploads a blob of another registry (or repository) without
+// storing it locally. Every chunk is streamed from the source with a range
+// request.
+func CopyBlob(hub *registry.Registry, repo string, src *registry.Registry, srcRepo string, d digest.Digest, size int64, opts UploadOptions) error {
+	open := func(off, n int64) (io.ReadCloser, error) {
+		return openBlobRange(src, srcRepo, d, off, n)
+	}
+	return uploadBlob(hub, repo, d, size, open, opts)
+}
+
+func uploadBlob(hub *registry.Registry, repo string, d digest.Digest, size int64, open func(off, n int64) (io.ReadCloser, error), opts UploadOptions) error {
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = defaultChunkSize
+	}
+	if opts.Retries <= 0 {
+		opts.Retries = defaultRetries
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = defaultBackoff
+	}
+
+	u := &blobUpload{hub: hub, repo: repo, digest: d, size: size, open: open, opts: opts}
+	return u.run()
+}
+
+func (u *blobUpload) run() error {
+	var (
+		location *url.URL
+		offset   int64
+		resume   bool
+		misread  bool
+		failures int
+		backoff  = u.opts.Backoff
+	)
+
+	for {
+		var err error
+
+		switch {
+		case location == nil:
+			location, err = initiateUpload(u.hub, u.repo)
+			offset = 0
+
+		case resume:
+			location, offset, err = u.status(location)
+			if misread && offset == 1 {
+				// registries like distribution report an empty session as
+				// 0-0 as well, which the rejected chunk at 1 showed
+				offset = 0
+			}
+			if httpStatus(err) == http.StatusNotFound {
+				// the session is gone, the blob may have been committed
+				// by a request whose response was lost
+				exists, herr := u.hub.HasLayer(u.repo, u.digest)
+				if herr == nil && exists {
+					return nil
+				}
+				// otherwise start a new session
+				location, resume, err = nil, false, nil
+			}
+			if err == nil {
+				resume = false
+			}
+
+		case offset < u.size:
+			start := offset
+			location, offset, err = u.patch(location, offset)
+			misread = start == 1 && httpStatus(err) == http.StatusRequestedRangeNotSatisfiable
+			if err == nil {
+				// only consecutive failures count against the retries
+				failures, backoff = 0, u.opts.Backoff
+			}
+
+		default:
+			err = u.commit(location)
+			if err == nil {
+				return nil
+			}
+		}
+
+		if err == nil {
+			continue
+		}
+		if !retryable(err) || failures >= u.opts.Retries {
+			return err
+		}
+
+		failures++
+		u.hub.Logf("registry.blob.retry repository=%s digest=%s offset=%d err=%s", u.repo, u.digest, offset, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+
+		if location != nil {
+			resume = true
+		}
+	}
+}
+
+// patch uploads the chunk at offset and returns the next location and
+// offset.
+func (u *blobUpload) patch(location *url.URL, offset int64) (*url.URL, int64, error) {
+	n := u.size - offset
+	if n > u.opts.ChunkSize {
+		n = u.opts.ChunkSize
+	}
+
+	u.hub.Logf("registry.blob.patch url=%s repository=%s digest=%s range=%d-%d", location, u.repo, u.digest, offset, offset+n-1)
+
+	body, err := u.open(offset, n)
+	if err != nil {
+		return location, offset, err
+	}
+
+	req, err := http.NewRequest("PATCH", location.String(), body)
+	if err != nil {
+		body.Close()
+		return location, offset, err
+	}
+	req.ContentLength = n
+	req.GetBody = func() (io.ReadCloser, error) {
+		return u.open(offset, n)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+n-1))
+
+	resp, err := u.hub.Client.Do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return location, offset, err
+	}
+
+	next, err := uploadLocation(location, resp)
+	if err != nil {
+		return location, offset, err
+	}
+
+	if end, ok := uploadOffset(resp); ok && end > offset {
+		return next, end, nil
+	}
+	return next, offset + n, nil
+}
+
+// commit completes the upload.
+func (u *blobUpload) commit(location *url.URL) error {
+	commitURL := *location
+	q := commitURL.Query()
+	q.Set("digest", u.digest.String())
+	commitURL.RawQuery = q.Encode()
+
+	u.hub.Logf("registry.blob.commit url=%s repository=%s digest=%s", &commitURL, u.repo, u.digest)
+
+	req, err := http.NewRequest("PUT", commitURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := u.hub.Client.Do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	return err
+}
+
+// status queries the upload session and returns its location and the
+// offset the upload must resume at.
+func (u *blobUpload) status(location *url.URL) (*url.URL, int64, error) {
+	u.hub.Logf("registry.blob.status url=%s repository=%s digest=%s", location, u.repo, u.digest)
+
+	resp, err := u.hub.Client.Get(location.String())
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return location, 0, err
+	}
+
+	next, err := uploadLocation(location, resp)
+	if err != nil {
+		return location, 0, err
+	}
+
+	end, _ := uploadOffset(resp)
+	return next, end, nil
+}
+
+// MountBlob links a blob that exists in another repository on the same
+// registry. It returns false when the registry doesn't mount the blob; the
+// blob must then be uploaded.
+func MountBlob(hub *registry.Registry, repo string, d digest.Digest, from string) (bool, error) {
+	q := url.Values{}
+	q.Set("mount", d.String())
+	q.Set("from", from)
+	mountURL := fmt.Sprintf("%s/v2/%s/blobs/uploads/?%s", strings.TrimSuffix(hub.URL, "/"), repo, q.Encode())
+	hub.Logf("registry.blob.mount url=%s repository=%s digest=%s from=%s", mountURL, repo, d, from)
+
+	resp, err := hub.Client.Post(mountURL, "application/octet-stream", nil)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode == http.StatusCreated {
+		return true, nil
+	}
+
+	// the registry started a regular upload instead, cancel it
+	base, err := url.Parse(mountURL)
+	if err != nil {
+		return false, err
+	}
+	location, err := uploadLocation(base, resp)
+	if err != nil || location == base {
+		return false, err
+	}
+
+	req, err := http.NewRequest("DELETE", location.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	cancelResp, err := hub.Client.Do(req)
+	if cancelResp != nil {
+		cancelResp.Body.Close()
+	}
+	if err != nil {
+		hub.Logf("registry.blob.cancel-upload url=%s err=%s", location, err)
+	}
+
+	return false, nil
+}
+
+// initiateUpload starts a blob upload and returns its location.
+func initiateUpload(hub *registry.Registry, repo string) (*url.URL, error) {
+	initiateURL := fmt.Sprintf("%s/v2/%s/blobs/uploads/", strings.TrimSuffix(hub.URL, "/"), repo)
+	hub.Logf("registry.blob.initiate-upload url=%s repository=%s", initiateURL, repo)
+
+	resp, err := hub.Client.Post(initiateURL, "application/octet-stream", nil)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	base, err := url.Parse(initiateURL)
+	if err != nil {
+		return nil, err
+	}
+	return uploadLocation(base, resp)
+}
+
+// uploadLocation returns the location for the next request of an upload.
+// Registries may return a location relative to the request URL, or none
+// at all when it doesn't change.
+func uploadLocation(current *url.URL, resp *http.Response) (*url.URL, error) {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return current, nil
+	}
+	return current.Parse(location)
+}
+
+// uploadOffset returns the number of bytes the registry has received,
+// based on the Range header of an upload response: none when there is no
+// header and N+1 for 0-N. It returns false when the header is malformed.
+func uploadOffset(resp *http.Response) (int64, bool) {
+	rng := strings.TrimPrefix(resp.Header.Get("Range"), "bytes=")
+	if rng == "" {
+		return 0, true
+	}
+
+	idx := strings.Index(rng, "-")
+	if idx < 0 {
+		return 0, false
+	}
+
+	end, err := strconv.ParseInt(rng[idx+1:], 10, 64)
+	if err != nil || end < 0 {
+		return 0, false
+	}
+	return end + 1, true
+}
+
+// httpStatus returns the status code of a failed registry request, or 0
+// when the request failed for another reason.
+func httpStatus(err error) int {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	if httpErr, ok := err.(*registry.HttpStatusError); ok {
+		return httpErr.Response.StatusCode
+	}
+	return 0
+}
+
+// retryable reports whether a failed request may succeed when it is
+// retried: network errors, server errors, throttling and range mismatches.
+func retryable(err error) bool {
+	if _, ok := err.(*url.Error); !ok {
+		return false
+	}
+
+	switch code := httpStatus(err); {
+	case code == 0, code >= 500:
+		return true
+	case code == http.StatusRequestTimeout, code == http.StatusTooManyRequests, code == http.StatusRequestedRangeNotSatisfiable:
+		return true
+	}
+	return false
+}
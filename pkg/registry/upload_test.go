@@ -0,0 +1,169 @@
+package dkrregistry
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/digest"
+	"github.com/fd/dkr-util/pkg/archive"
+)
+
+var testUploadOpts = UploadOptions{ChunkSize: 4, Retries: 3, Backoff: time.Millisecond}
+
+func testUpload(t *testing.T, f *fakeRegistry, data string) {
+	hub, srv := f.serve()
+	defer srv.Close()
+
+	content := dkrarchive.Bytes([]byte(data))
+	err := UploadBlob(hub, "app", content.Digest, content, testUploadOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(f.blobs["app@"+content.Digest.String()]); got != data {
+		t.Fatalf("expected blob %q, got %q", data, got)
+	}
+}
+
+func expectPatches(t *testing.T, f *fakeRegistry, expected ...string) {
+	if !reflect.DeepEqual(f.patches, expected) {
+		t.Fatalf("expected patches %q, got %q", expected, f.patches)
+	}
+}
+
+func TestUploadBlob(t *testing.T) {
+	f := newFakeRegistry()
+	testUpload(t, f, "0123456789")
+	expectPatches(t, f, "0-3", "4-7", "8-9")
+}
+
+func TestUploadBlobRetriesChunk(t *testing.T) {
+	f := newFakeRegistry()
+	f.failPatches = 1
+	testUpload(t, f, "0123456789")
+	expectPatches(t, f, "0-3", "0-3", "4-7", "8-9")
+}
+
+func TestUploadBlobResumesFromRange(t *testing.T) {
+	f := newFakeRegistry()
+	f.failPatches = 1
+	f.storeOnFail = 2
+	testUpload(t, f, "0123456789")
+	expectPatches(t, f, "0-3", "2-5", "6-9")
+}
+
+func TestUploadBlobResumesAfterOneByte(t *testing.T) {
+	f := newFakeRegistry()
+	f.failPatches = 1
+	f.storeOnFail = 1
+	testUpload(t, f, "0123456789")
+	expectPatches(t, f, "0-3", "1-4", "5-8", "9-9")
+}
+
+func TestUploadBlobResumesEmptyRange(t *testing.T) {
+	f := newFakeRegistry()
+	f.failPatches = 1
+	f.emptyRange = true
+	testUpload(t, f, "0123456789")
+	expectPatches(t, f, "0-3", "1-4", "0-3", "4-7", "8-9")
+}
+
+func TestUploadOffset(t *testing.T) {
+	tests := []struct {
+		rng    string
+		offset int64
+		ok     bool
+	}{
+		{rng: "", offset: 0, ok: true},
+		{rng: "0-0", offset: 1, ok: true},
+		{rng: "0-9", offset: 10, ok: true},
+		{rng: "bytes=0-4", offset: 5, ok: true},
+		{rng: "0", ok: false},
+		{rng: "0-x", ok: false},
+		{rng: "0--1", ok: false},
+	}
+
+	for _, test := range tests {
+		resp := &http.Response{Header: http.Header{}}
+		if test.rng != "" {
+			resp.Header.Set("Range", test.rng)
+		}
+
+		offset, ok := uploadOffset(resp)
+		if offset != test.offset || ok != test.ok {
+			t.Errorf("%q: expected %d %v, got %d %v", test.rng, test.offset, test.ok, offset, ok)
+		}
+	}
+}
+
+func TestUploadBlobRestartsLostSession(t *testing.T) {
+	f := newFakeRegistry()
+	f.failPatches = 1
+	f.storeOnFail = 2
+	f.dropSessions = 1
+	testUpload(t, f, "0123456789")
+	expectPatches(t, f, "0-3", "0-3", "4-7", "8-9")
+
+	if f.initiated != 2 {
+		t.Fatalf("expected 2 upload sessions, got %d", f.initiated)
+	}
+}
+
+func TestUploadBlobGivesUp(t *testing.T) {
+	f := newFakeRegistry()
+	f.failPatches = 10
+	hub, srv := f.serve()
+	defer srv.Close()
+
+	content := dkrarchive.Bytes([]byte("0123456789"))
+	err := UploadBlob(hub, "app", content.Digest, content, testUploadOpts)
+	if err == nil {
+		t.Fatal("expected the upload to fail")
+	}
+	if len(f.patches) != testUploadOpts.Retries+1 {
+		t.Fatalf("expected %d patches, got %q", testUploadOpts.Retries+1, f.patches)
+	}
+}
+
+func TestMountBlob(t *testing.T) {
+	f := newFakeRegistry()
+	f.mount = true
+	d, _ := digest.FromBytes([]byte("layer"))
+	f.blobs["base@"+d.String()] = []byte("layer")
+
+	hub, srv := f.serve()
+	defer srv.Close()
+
+	mounted, err := MountBlob(hub, "app", d, "base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mounted {
+		t.Fatal("expected the blob to be mounted")
+	}
+	if string(f.blobs["app@"+d.String()]) != "layer" {
+		t.Fatal("expected the blob in app")
+	}
+}
+
+func TestMountBlobFallback(t *testing.T) {
+	f := newFakeRegistry()
+	d, _ := digest.FromBytes([]byte("layer"))
+	f.blobs["base@"+d.String()] = []byte("layer")
+
+	hub, srv := f.serve()
+	defer srv.Close()
+
+	mounted, err := MountBlob(hub, "app", d, "base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mounted {
+		t.Fatal("expected the blob not to be mounted")
+	}
+	if len(f.canceled) != 1 || len(f.sessions) != 0 {
+		t.Fatalf("expected the upload the registry started to be canceled, canceled %q", f.canceled)
+	}
+}
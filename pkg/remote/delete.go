@@ -0,0 +1,194 @@
+package dkrremote
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/digest"
+	"github.com/fd/dkr-util/pkg/registry"
+)
+
+// DeleteOptions control how manifests are deleted.
+type DeleteOptions struct {
+	// DryRun only prints what would be deleted.
+	DryRun bool
+
+	// Registry holds the connection settings for the registry.
+	Registry dkrregistry.Config
+}
+
+// PruneOptions are the retention rules of Prune. A tag is deleted when no
+// rule keeps it. Tags with an unknown creation time are always kept.
+type PruneOptions struct {
+	DeleteOptions
+
+	// Keep keeps the newest Keep tags.
+	Keep int
+
+	// KeepTags keeps the tags that match one of these globs. They only
+	// exempt tags from Keep and OlderThan, one of which must be set.
+	KeepTags []string
+
+	// OlderThan keeps the tags that were created less than OlderThan ago.
+	OlderThan time.Duration
+}
+
+// Delete deletes the manifest a reference points to. Registries delete
+// manifests by digest, so every tag of the manifest is removed.
+func Delete(name string, opts DeleteOptions) error {
+	ref := dkrregistry.ParseRef(name)
+
+	hub, err := dkrregistry.Dial(ref.Registry, opts.Registry)
+	if err != nil {
+		return err
+	}
+
+	d, err := dkrregistry.ManifestDigest(hub, ref.Repo, ref.Reference())
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "%s %s@%s\n", opts.verb(), ref.Name(), d)
+	if opts.DryRun {
+		return nil
+	}
+	return dkrregistry.DeleteManifest(hub, ref.Repo, d)
+}
+
+// Prune deletes the tags of a repository that the retention rules don't
+// keep. A manifest is only deleted when all its tags are deleted; the
+// platform manifests of deleted multi-platform images are deleted with
+// them.
+func Prune(name string, opts PruneOptions) error {
+	if opts.Keep <= 0 && opts.OlderThan <= 0 {
+		if len(opts.KeepTags) > 0 {
+			// keep tags alone would delete every tag that doesn't match
+			return errors.New("keep tags only exempt tags from keep and older than, set one of them")
+		}
+		return errors.New("prune needs a retention rule (keep or older than)")
+	}
+	for _, pattern := range opts.KeepTags {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid tag pattern %q: %s", pattern, err)
+		}
+	}
+
+	ref := dkrregistry.ParseRef(name)
+
+	hub, err := dkrregistry.Dial(ref.Registry, opts.Registry)
+	if err != nil {
+		return err
+	}
+
+	tags, err := dkrregistry.ListTags(hub, ref.Repo)
+	if err != nil {
+		return err
+	}
+
+	var infos []*tagInfo
+	for _, tag := range tags {
+		info := &tagInfo{Tag: tag}
+		err = inspectTag(hub, ref.Repo, info)
+		if err != nil {
+			return err
+		}
+		infos = append(infos, info)
+	}
+
+	// newest first, tags without a creation time last
+	sort.SliceStable(infos, func(i, j int) bool {
+		ti, tj := createdTime(infos[i]), createdTime(infos[j])
+		if !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+		return infos[i].Tag < infos[j].Tag
+	})
+
+	var (
+		now      = time.Now()
+		kept     = map[string]bool{}
+		keptTags = map[string][]string{}
+		doomed   []*tagInfo
+	)
+	for i, info := range infos {
+		if opts.keeps(i, info, now) {
+			kept[info.Digest] = true
+			keptTags[info.Digest] = append(keptTags[info.Digest], info.Tag)
+			for _, d := range info.manifests {
+				kept[d.String()] = true
+			}
+			continue
+		}
+		doomed = append(doomed, info)
+	}
+
+	var (
+		deleted  = map[string]bool{}
+		children []digest.Digest
+	)
+	for _, info := range doomed {
+		if kept[info.Digest] {
+			fmt.Fprintf(os.Stderr, "Keeping  %s:%s (same manifest as %s)\n", ref.Name(), info.Tag, strings.Join(keptTags[info.Digest], ", "))
+			continue
+		}
+
+		fmt.Fprintf(os.Stderr, "%s %s:%s\n", opts.verb(), ref.Name(), info.Tag)
+		if deleted[info.Digest] {
+			continue
+		}
+		deleted[info.Digest] = true
+		children = append(children, info.manifests...)
+
+		if !opts.DryRun {
+			err = dkrregistry.DeleteManifest(hub, ref.Repo, digest.Digest(info.Digest))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, d := range children {
+		if kept[d.String()] || deleted[d.String()] {
+			continue
+		}
+		deleted[d.String()] = true
+
+		fmt.Fprintf(os.Stderr, "%s %s@%s\n", opts.verb(), ref.Name(), d)
+		if !opts.DryRun {
+			err = dkrregistry.DeleteManifest(hub, ref.Repo, d)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// keeps reports whether the i-th newest tag is kept.
+func (opts PruneOptions) keeps(i int, info *tagInfo, now time.Time) bool {
+	created := createdTime(info)
+	if i < opts.Keep || created.IsZero() {
+		return true
+	}
+
+	for _, pattern := range opts.KeepTags {
+		if ok, _ := path.Match(pattern, info.Tag); ok {
+			return true
+		}
+	}
+
+	return opts.OlderThan > 0 && now.Sub(created) < opts.OlderThan
+}
+
+func (opts DeleteOptions) verb() string {
+	if opts.DryRun {
+		return "Would delete"
+	}
+	return "Deleting"
+}
@@ -0,0 +1,216 @@
+package dkrremote
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/distribution/digest"
+	"github.com/fd/dkr-util/pkg/archive"
+	"github.com/fd/dkr-util/pkg/registry"
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+// ListOptions control what List prints.
+type ListOptions struct {
+	// Long adds the manifest digest, media type, size and creation time
+	// of every tag.
+	Long bool
+
+	// JSON prints the tags as a JSON array of objects.
+	JSON bool
+
+	// Registry holds the connection settings for the registry.
+	Registry dkrregistry.Config
+}
+
+type tagInfo struct {
+	Tag       string   `json:"tag"`
+	Digest    string   `json:"digest,omitempty"`
+	MediaType string   `json:"media_type,omitempty"`
+	Size      int64    `json:"size,omitempty"`
+	Created   string   `json:"created,omitempty"`
+	Platforms []string `json:"platforms,omitempty"`
+
+	// manifests are the platform manifests of a multi-platform image.
+	manifests []digest.Digest
+}
+
+// List prints the tags of a repository, sorted by name. In long or JSON
+// mode the manifest of every tag is fetched as well. The size of an image
+// is the size of its config and compressed layers; multi-platform images
+// list their platforms instead and were created with their newest image.
+func List(dst io.Writer, name string, opts ListOptions) error {
+	ref := dkrregistry.ParseRef(name)
+
+	hub, err := dkrregistry.Dial(ref.Registry, opts.Registry)
+	if err != nil {
+		return err
+	}
+
+	tags, err := dkrregistry.ListTags(hub, ref.Repo)
+	if err != nil {
+		return err
+	}
+	sort.Strings(tags)
+
+	infos := []*tagInfo{}
+	for _, tag := range tags {
+		info := &tagInfo{Tag: tag}
+		if opts.Long || opts.JSON {
+			err = inspectTag(hub, ref.Repo, info)
+			if err != nil {
+				return err
+			}
+		}
+		infos = append(infos, info)
+	}
+
+	if opts.JSON {
+		data, err := json.MarshalIndent(infos, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(dst, "%s\n", data)
+		return err
+	}
+
+	if !opts.Long {
+		for _, info := range infos {
+			_, err = fmt.Fprintln(dst, info.Tag)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(dst, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TAG\tDIGEST\tTYPE\tSIZE\tCREATED\tPLATFORMS")
+	for _, info := range infos {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			info.Tag, info.Digest, shortMediaType(info.MediaType), orDash(info.Size), orDash(info.Created), orDash(strings.Join(info.Platforms, ",")))
+	}
+	return w.Flush()
+}
+
+// inspectTag fills in the manifest details of a tag.
+func inspectTag(hub *registry.Registry, repo string, info *tagInfo) error {
+	mediaType, data, err := dkrregistry.GetManifestOrIndex(hub, repo, info.Tag)
+	if err != nil {
+		return err
+	}
+
+	info.MediaType = mediaType
+	info.Digest = dkrarchive.Bytes(data).Digest.String()
+	if mediaType == dkrarchive.MediaTypeManifestV1 || mediaType == dkrarchive.MediaTypeManifestV1Sig {
+		// the digest of a signed manifest excludes the signatures
+		d, err := dkrregistry.ManifestDigest(hub, repo, info.Tag)
+		if err != nil {
+			return err
+		}
+		info.Digest = d.String()
+	}
+
+	switch {
+	case dkrarchive.IsIndex(mediaType):
+		var index dkrarchive.Index
+		err = json.Unmarshal(data, &index)
+		if err != nil {
+			return err
+		}
+
+		info.Platforms = []string{}
+		for _, desc := range index.Manifests {
+			if desc.Platform != nil {
+				info.Platforms = append(info.Platforms, desc.Platform.String())
+			}
+			info.manifests = append(info.manifests, desc.Digest)
+
+			// the image index was created with its newest image
+			img := &tagInfo{Tag: desc.Digest.String()}
+			err = inspectTag(hub, repo, img)
+			if err != nil {
+				return err
+			}
+			if createdTime(img).After(createdTime(info)) {
+				info.Created = img.Created
+			}
+		}
+
+	case mediaType == dkrarchive.MediaTypeManifestV2 || mediaType == dkrarchive.MediaTypeOCIManifest:
+		var mani dkrarchive.Manifest
+		err = json.Unmarshal(data, &mani)
+		if err != nil {
+			return err
+		}
+
+		info.Size = mani.Config.Size
+		for _, l := range mani.Layers {
+			info.Size += l.Size
+		}
+
+		info.Created, err = configCreated(hub, repo, mani.Config.Digest)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// configCreated returns the creation time from an image config.
+func configCreated(hub *registry.Registry, repo string, d digest.Digest) (string, error) {
+	body, err := hub.DownloadLayer(repo, d)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	var conf struct {
+		Created string `json:"created"`
+	}
+	err = json.NewDecoder(body).Decode(&conf)
+	if err != nil {
+		return "", err
+	}
+	return conf.Created, nil
+}
+
+// createdTime returns the creation time of a tag, or the zero time when it
+// is unknown.
+func createdTime(info *tagInfo) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, info.Created)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+func shortMediaType(mediaType string) string {
+	switch mediaType {
+	case dkrarchive.MediaTypeManifestV2:
+		return "docker"
+	case dkrarchive.MediaTypeManifestList:
+		return "docker-list"
+	case dkrarchive.MediaTypeOCIManifest:
+		return "oci"
+	case dkrarchive.MediaTypeOCIIndex:
+		return "oci-index"
+	case dkrarchive.MediaTypeManifestV1, dkrarchive.MediaTypeManifestV1Sig:
+		return "schema1"
+	}
+	return mediaType
+}
+
+func orDash(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || s == "0" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,161 @@
+package dkrtag
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/fd/dkr-util/pkg/archive"
+	"github.com/fd/dkr-util/pkg/push"
+	"github.com/fd/dkr-util/pkg/registry"
+)
+
+// Options control how tags are added to an image archive.
+type Options struct {
+	// Image selects the image to tag when the archive contains several.
+	Image string
+
+	// Replace removes the current tags of the image.
+	Replace bool
+}
+
+// Remote tags an image in a registry without uploading it again. Its
+// manifest is fetched once and put under every tag. Tags are normalized
+// like repo tags; a tag like `:production` is in the repository of the
+// image. Tags in other repositories get a copy of the image.
+func Remote(name string, tags []string, opts dkrpush.Options) error {
+	src := dkrregistry.ParseRef(name)
+
+	refs, err := expandTags(tags, []dkrregistry.Ref{src})
+	if err != nil {
+		return err
+	}
+
+	hub, err := dkrregistry.Dial(src.Registry, opts.Registry)
+	if err != nil {
+		return err
+	}
+
+	mediaType, data, err := dkrregistry.GetManifestOrIndex(hub, src.Repo, src.Reference())
+	if err != nil {
+		return err
+	}
+	pinned := src.Name() + "@" + dkrarchive.Bytes(data).Digest.String()
+
+	for _, ref := range refs {
+		if ref.Registry != src.Registry || ref.Repo != src.Repo {
+			_, err = dkrpush.Copy(pinned, ref.String(), opts)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		_, err = dkrregistry.PutManifest(hub, ref.Repo, ref.Tag, mediaType, data)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Tagged %s\n", ref)
+	}
+
+	return nil
+}
+
+// Archive copies an image archive to dst with tags added to one of its
+// images. Only manifest.json (or index.json) is rewritten.
+func Archive(dst io.Writer, src io.Reader, tags []string, opts Options) error {
+	return dkrarchive.Retag(dst, src, func(current [][]string) ([][]string, error) {
+		i, err := selectImage(current, opts.Image)
+		if err != nil {
+			return nil, err
+		}
+
+		var repos []dkrregistry.Ref
+		for _, tag := range current[i] {
+			repos = append(repos, dkrregistry.ParseRef(tag))
+		}
+
+		refs, err := expandTags(tags, repos)
+		if err != nil {
+			return nil, err
+		}
+
+		var (
+			newTags []string
+			seen    = map[string]bool{}
+		)
+		if !opts.Replace {
+			for _, tag := range current[i] {
+				seen[tag] = true
+				newTags = append(newTags, tag)
+			}
+		}
+		for _, ref := range refs {
+			if !seen[ref.String()] {
+				seen[ref.String()] = true
+				newTags = append(newTags, ref.String())
+			}
+		}
+
+		current[i] = newTags
+		return current, nil
+	})
+}
+
+// selectImage returns the index of the image with the given repo tag, or
+// of the only image when name is empty.
+func selectImage(tags [][]string, name string) (int, error) {
+	if name == "" {
+		if len(tags) != 1 {
+			return 0, fmt.Errorf("archive contains %d images, select one with --image", len(tags))
+		}
+		return 0, nil
+	}
+
+	name = dkrregistry.ParseRef(name).String()
+	for i, imageTags := range tags {
+		for _, tag := range imageTags {
+			if dkrregistry.ParseRef(tag).String() == name {
+				return i, nil
+			}
+		}
+	}
+
+	return 0, fmt.Errorf("image %s not found", name)
+}
+
+// expandTags normalizes tags. A tag that starts with a colon is added to
+// every repository of repos.
+func expandTags(tags []string, repos []dkrregistry.Ref) ([]dkrregistry.Ref, error) {
+	var refs []dkrregistry.Ref
+
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, ":") {
+			if len(tag) == 1 || strings.ContainsAny(tag[1:], ":/@") {
+				return nil, fmt.Errorf("invalid tag %q", tag)
+			}
+			if len(repos) == 0 {
+				return nil, fmt.Errorf("image has no repository for tag %s", tag)
+			}
+
+			seen := map[string]bool{}
+			for _, repo := range repos {
+				ref := dkrregistry.Ref{Registry: repo.Registry, Repo: repo.Repo, Tag: tag[1:]}
+				if !seen[ref.Name()] {
+					seen[ref.Name()] = true
+					refs = append(refs, ref)
+				}
+			}
+			continue
+		}
+
+		ref := dkrregistry.ParseRef(tag)
+		if ref.Digest != "" {
+			return nil, fmt.Errorf("can't tag with a digest: %s", tag)
+		}
+		refs = append(refs, ref)
+	}
+
+	return refs, nil
+}